@@ -2,8 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"gopkg.in/yaml.v2"
 )
 
@@ -13,6 +17,337 @@ type Config struct {
 	PromBind string   `yaml:"prometheus_bind"`
 	Zone     string   `yaml:"zone"`
 	Services []string `yaml:"services"`
+
+	Backend string     `yaml:"backend"`
+	File    FileConfig `yaml:"file"`
+
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	Etcd       EtcdConfig       `yaml:"etcd"`
+	Nomad      NomadConfig      `yaml:"nomad"`
+
+	HTTPBackend HTTPBackendConfig `yaml:"http_backend"`
+
+	EstimateCheckPropagation bool `yaml:"estimate_check_propagation"`
+
+	LogLevel  string `yaml:"log_level"`
+	LogFormat string `yaml:"log_format"`
+
+	Health  HealthConfig  `yaml:"health"`
+	History HistoryConfig `yaml:"history"`
+	Admin   AdminConfig   `yaml:"admin"`
+	HTTP    HTTPConfig    `yaml:"http"`
+
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
+	Dnstap DnstapConfig `yaml:"dnstap"`
+
+	Tracing TracingConfig `yaml:"tracing"`
+
+	Registration RegistrationConfig `yaml:"registration"`
+
+	Publish PublishConfig `yaml:"publish"`
+
+	HA HAConfig `yaml:"ha"`
+
+	Derived DerivedConfig `yaml:"derived"`
+
+	Views []ViewConfig `yaml:"views"`
+
+	Geo GeoConfig `yaml:"geo"`
+
+	ECSTrustedNetworks []string `yaml:"ecs_trusted_networks"`
+
+	ServiceConfig map[string]ServiceConfig `yaml:"service_config"`
+}
+
+// Service backends from which service addresses are fetched
+const (
+	backendConsul     = "consul"
+	backendFile       = "file"
+	backendKubernetes = "kubernetes"
+	backendEtcd       = "etcd"
+	backendNomad      = "nomad"
+	backendHTTP       = "http"
+)
+
+// KubernetesConfig details how the kubernetes backend connects to the
+// Kubernetes API. If Kubeconfig is empty, the in-cluster config is used.
+type KubernetesConfig struct {
+	Kubeconfig string `yaml:"kubeconfig"`
+	Namespace  string `yaml:"namespace"`
+}
+
+// FileConfig details the file from which service addresses are read by the
+// file backend
+type FileConfig struct {
+	Path         string        `yaml:"path"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// EtcdConfig details how the etcd backend connects to etcd, and the key
+// prefix under which services are registered
+type EtcdConfig struct {
+	Endpoints   []string      `yaml:"endpoints"`
+	Prefix      string        `yaml:"prefix"`
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	Username    string        `yaml:"username"`
+	Password    string        `yaml:"password"`
+}
+
+// NomadConfig details how the nomad backend connects to Nomad. Unset values
+// are read from the Nomad SDK's environment variables.
+type NomadConfig struct {
+	Address   string        `yaml:"address"`
+	Namespace string        `yaml:"namespace"`
+	Region    string        `yaml:"region"`
+	Token     string        `yaml:"token"`
+	WaitTime  time.Duration `yaml:"wait_time"`
+}
+
+// HTTPBackendConfig details how the http backend polls a JSON endpoint. The
+// string {service} in URL is replaced with the name of each service.
+type HTTPBackendConfig struct {
+	URL        string        `yaml:"url"`
+	Path       string        `yaml:"path"`
+	Interval   time.Duration `yaml:"interval"`
+	Timeout    time.Duration `yaml:"timeout"`
+	AuthHeader string        `yaml:"auth_header"`
+	ETag       bool          `yaml:"etag"`
+}
+
+// DnstapConfig details where dnstap messages are written. At most one of
+// Unix, TCP or File may be set; if none are set, dnstap is disabled.
+type DnstapConfig struct {
+	Unix       string `yaml:"unix"`
+	TCP        string `yaml:"tcp"`
+	File       string `yaml:"file"`
+	Identity   string `yaml:"identity"`
+	BufferSize int    `yaml:"buffer_size"`
+}
+
+// Enabled returns true if a dnstap output is defined
+func (d DnstapConfig) Enabled() bool {
+	return d.Unix != "" || d.TCP != "" || d.File != ""
+}
+
+// TracingConfig details how OpenTelemetry spans are exported. If Endpoint
+// is empty, tracing is disabled.
+type TracingConfig struct {
+	Endpoint         string  `yaml:"endpoint"`
+	Insecure         bool    `yaml:"insecure"`
+	SampleRatio      float64 `yaml:"sample_ratio"`
+	QuerySampleRatio float64 `yaml:"query_sample_ratio"`
+}
+
+// RegistrationConfig details how hobson registers itself as a Consul service.
+// An empty ID is derived from Name and the hostname.
+type RegistrationConfig struct {
+	Enabled       bool              `yaml:"enabled"`
+	Name          string            `yaml:"name"`
+	ID            string            `yaml:"id"`
+	Address       string            `yaml:"address"`
+	Tags          []string          `yaml:"tags"`
+	Meta          map[string]string `yaml:"meta"`
+	CheckInterval time.Duration     `yaml:"check_interval"`
+	CheckTimeout  time.Duration     `yaml:"check_timeout"`
+}
+
+// PublishConfig details how selected records are published to Consul KV.
+// An empty Instance is derived from the hostname.
+type PublishConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Prefix   string `yaml:"prefix"`
+	Instance string `yaml:"instance"`
+}
+
+// HAConfig details how record selection is coordinated among a group of
+// instances. An empty Instance is derived from the hostname.
+type HAConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Prefix     string        `yaml:"prefix"`
+	Instance   string        `yaml:"instance"`
+	SessionTTL time.Duration `yaml:"session_ttl"`
+}
+
+// DerivedConfig details the Consul services registered for the selected
+// record of each service. The name of each derived service is the name of
+// the service followed by Suffix. The TTL check of each derived service is
+// passed every CheckInterval, so that it fails if hobson stops.
+type DerivedConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Suffix        string        `yaml:"suffix"`
+	Tags          []string      `yaml:"tags"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+// ViewConfig details a view answering queries from clients in Networks.
+// Records for a view may be selected from a different Datacenter, using a
+// tagged address of each instance, or with a different Selection mode than
+// the default view.
+type ViewConfig struct {
+	Name          string   `yaml:"name"`
+	Networks      []string `yaml:"networks"`
+	Datacenter    string   `yaml:"datacenter"`
+	TaggedAddress string   `yaml:"tagged_address"`
+	Selection     string   `yaml:"selection"`
+}
+
+// GeoConfig details how client addresses are mapped to regions, from either
+// a File mapping regions to networks, or a MaxMind-format database. The
+// region of each instance is read from its Consul node meta.
+type GeoConfig struct {
+	File        string `yaml:"file"`
+	MaxMindDB   string `yaml:"maxmind_db"`
+	MaxMindPath string `yaml:"maxmind_path"`
+	NodeMeta    string `yaml:"node_meta"`
+}
+
+// Enabled returns true if regional selection is configured
+func (g GeoConfig) Enabled() bool {
+	return g.File != "" || g.MaxMindDB != ""
+}
+
+// ServiceConfig details optional behavior for a single service
+type ServiceConfig struct {
+	OnChange        []string      `yaml:"on_change"`
+	OnChangeTimeout time.Duration `yaml:"on_change_timeout"`
+	Selection       string        `yaml:"selection"`
+	LockKey         string        `yaml:"lock_key"`
+
+	NearestNode      string        `yaml:"nearest_node"`
+	NearestThreshold time.Duration `yaml:"nearest_threshold"`
+
+	KubernetesService string `yaml:"kubernetes_service"`
+	EtcdPrefix        string `yaml:"etcd_prefix"`
+	HTTPURL           string `yaml:"http_url"`
+
+	Probe *ProbeConfig `yaml:"probe"`
+}
+
+// ProbeConfig details an active health probe run by hobson against each
+// healthy address of a service. Type is one of tcp, http, dns, or tls.
+type ProbeConfig struct {
+	Type               string        `yaml:"type"`
+	Port               int           `yaml:"port"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	Rise               int           `yaml:"rise"`
+	Fall               int           `yaml:"fall"`
+	Scheme             string        `yaml:"scheme"`
+	Path               string        `yaml:"path"`
+	ExpectStatus       int           `yaml:"expect_status"`
+	QueryName          string        `yaml:"query_name"`
+	ServerName         string        `yaml:"server_name"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+}
+
+// Record selection modes. With selectionLowest, the lowest healthy address
+// is selected when the current record becomes unhealthy. With selectionLock,
+// the address of the node holding a Consul lock is selected. With
+// selectionNearest, the address closest to a reference node by Consul's
+// network coordinates is selected.
+const (
+	selectionLowest  = "lowest"
+	selectionLock    = "lock"
+	selectionNearest = "nearest"
+)
+
+// HealthConfig sets the thresholds past which a service backend is
+// reported as unhealthy. A zero value disables the given threshold.
+type HealthConfig struct {
+	MaxConsecutiveErrors uint64        `yaml:"max_consecutive_errors"`
+	MaxFetchAge          time.Duration `yaml:"max_fetch_age"`
+}
+
+// HistoryConfig details how record changes are retained
+type HistoryConfig struct {
+	Size int    `yaml:"size"`
+	Path string `yaml:"path"`
+}
+
+// AdminConfig details the availability of administrative HTTP endpoints
+type AdminConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// HTTPConfig details how the Prometheus exposition HTTP server is secured,
+// and whether profiling endpoints are exposed
+type HTTPConfig struct {
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	BearerToken string `yaml:"bearer_token"`
+	Pprof       bool   `yaml:"pprof"`
+}
+
+// WebhookConfig details a webhook to be notified of record changes. If
+// Services is empty, changes for all services are sent.
+type WebhookConfig struct {
+	URL       string        `yaml:"url"`
+	Services  []string      `yaml:"services"`
+	Template  string        `yaml:"template"`
+	Secret    string        `yaml:"secret"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Retries   uint64        `yaml:"retries"`
+	QueueSize int           `yaml:"queue_size"`
+}
+
+const (
+	defaultMaxConsecutiveErrors = 5
+	defaultMaxFetchAge          = time.Minute * 10
+	defaultHistorySize          = 1000
+	defaultWebhookTemplate      = "json"
+	defaultWebhookTimeout       = time.Second * 5
+	defaultWebhookRetries       = 3
+	defaultWebhookQueueSize     = 100
+	defaultOnChangeTimeout      = time.Second * 30
+	defaultNearestThreshold     = time.Millisecond * 5
+	defaultMaxMindPath          = "$.country.iso_code"
+	defaultGeoNodeMeta          = "region"
+	defaultDnstapBufferSize     = 1024
+	defaultTraceSampleRatio     = 1
+	defaultRegistrationName     = "hobson"
+	defaultCheckInterval        = time.Second * 10
+	defaultCheckTimeout         = time.Second * 2
+	defaultPublishPrefix        = "hobson/selections"
+	defaultHAPrefix             = "hobson/ha"
+	defaultSessionTTL           = time.Second * 15
+	defaultDerivedSuffix        = "-primary"
+	defaultBackend              = backendConsul
+	defaultFilePollInterval     = time.Second
+	defaultKubernetesNamespace  = "default"
+	defaultEtcdPrefix           = "/services"
+	defaultEtcdDialTimeout      = time.Second * 5
+	defaultNomadWaitTime        = time.Second * 30
+	defaultHTTPBackendInterval  = time.Second * 10
+	defaultHTTPBackendTimeout   = time.Second * 5
+	defaultProbeInterval        = time.Second * 5
+	defaultProbeTimeout         = time.Second * 2
+	defaultProbeRise            = 2
+	defaultProbeFall            = 3
+	defaultProbeScheme          = "http"
+	defaultProbePath            = "/"
+	defaultProbeExpectStatus    = 200
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler, applying defaults to
+// unset WebhookConfig values
+func (w *WebhookConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type raw WebhookConfig
+	r := raw{
+		Template:  defaultWebhookTemplate,
+		Timeout:   defaultWebhookTimeout,
+		Retries:   defaultWebhookRetries,
+		QueueSize: defaultWebhookQueueSize,
+	}
+
+	if err := unmarshal(&r); err != nil {
+		return err
+	}
+
+	*w = WebhookConfig(r)
+	return nil
 }
 
 func hasDuplicate(haystack []string) bool {
@@ -29,6 +364,66 @@ func hasDuplicate(haystack []string) bool {
 	return false
 }
 
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, applying defaults to
+// unset ServiceConfig values
+func (s *ServiceConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type raw ServiceConfig
+	r := raw{
+		OnChangeTimeout:  defaultOnChangeTimeout,
+		NearestThreshold: defaultNearestThreshold,
+	}
+
+	if err := unmarshal(&r); err != nil {
+		return err
+	}
+
+	*s = ServiceConfig(r)
+	return nil
+}
+
+// nearestThreshold returns the nearest_threshold of a service. The default
+// applies to services without a ServiceConfig, such as those selected by
+// nearest in a view, and to a threshold of zero.
+func (c *Config) nearestThreshold(service string) time.Duration {
+	if t := c.ServiceConfig[service].NearestThreshold; t > 0 {
+		return t
+	}
+
+	return defaultNearestThreshold
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, applying defaults to
+// unset ProbeConfig values
+func (p *ProbeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type raw ProbeConfig
+	r := raw{
+		Interval:     defaultProbeInterval,
+		Timeout:      defaultProbeTimeout,
+		Rise:         defaultProbeRise,
+		Fall:         defaultProbeFall,
+		Scheme:       defaultProbeScheme,
+		Path:         defaultProbePath,
+		ExpectStatus: defaultProbeExpectStatus,
+	}
+
+	if err := unmarshal(&r); err != nil {
+		return err
+	}
+
+	*p = ProbeConfig(r)
+	return nil
+}
+
 // NewConfig creates and validate a new Config object, given a specified filesystem path
 func NewConfig(path string) (*Config, error) {
 	f, err := ioutil.ReadFile(path)
@@ -36,7 +431,59 @@ func NewConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	var config Config
+	config := Config{
+		Backend: defaultBackend,
+		File: FileConfig{
+			PollInterval: defaultFilePollInterval,
+		},
+		Kubernetes: KubernetesConfig{
+			Namespace: defaultKubernetesNamespace,
+		},
+		Etcd: EtcdConfig{
+			Prefix:      defaultEtcdPrefix,
+			DialTimeout: defaultEtcdDialTimeout,
+		},
+		Nomad: NomadConfig{
+			WaitTime: defaultNomadWaitTime,
+		},
+		HTTPBackend: HTTPBackendConfig{
+			Interval: defaultHTTPBackendInterval,
+			Timeout:  defaultHTTPBackendTimeout,
+		},
+		Health: HealthConfig{
+			MaxConsecutiveErrors: defaultMaxConsecutiveErrors,
+			MaxFetchAge:          defaultMaxFetchAge,
+		},
+		History: HistoryConfig{
+			Size: defaultHistorySize,
+		},
+		Dnstap: DnstapConfig{
+			BufferSize: defaultDnstapBufferSize,
+		},
+		Geo: GeoConfig{
+			MaxMindPath: defaultMaxMindPath,
+			NodeMeta:    defaultGeoNodeMeta,
+		},
+		Tracing: TracingConfig{
+			SampleRatio: defaultTraceSampleRatio,
+		},
+		Registration: RegistrationConfig{
+			Name:          defaultRegistrationName,
+			CheckInterval: defaultCheckInterval,
+			CheckTimeout:  defaultCheckTimeout,
+		},
+		Publish: PublishConfig{
+			Prefix: defaultPublishPrefix,
+		},
+		HA: HAConfig{
+			Prefix:     defaultHAPrefix,
+			SessionTTL: defaultSessionTTL,
+		},
+		Derived: DerivedConfig{
+			Suffix:        defaultDerivedSuffix,
+			CheckInterval: defaultCheckInterval,
+		},
+	}
 	err = yaml.Unmarshal(f, &config)
 	if err != nil {
 		return nil, err
@@ -72,5 +519,288 @@ func (c *Config) Validate() error {
 		return errors.New("'Services' contains duplicate entries")
 	}
 
+	switch c.Backend {
+	case "", backendConsul:
+	case backendFile:
+		if c.File.Path == "" {
+			return errors.New("'File.Path' must be set with the 'file' backend")
+		}
+
+		if c.File.PollInterval <= 0 {
+			return errors.New("'File.PollInterval' must be positive")
+		}
+	case backendKubernetes:
+		if c.Kubernetes.Namespace == "" {
+			return errors.New("'Kubernetes.Namespace' must be set with the 'kubernetes' backend")
+		}
+	case backendEtcd:
+		if len(c.Etcd.Endpoints) == 0 {
+			return errors.New("'Etcd.Endpoints' must be set with the 'etcd' backend")
+		}
+	case backendNomad:
+		if c.Nomad.WaitTime <= 0 {
+			return errors.New("'Nomad.WaitTime' must be positive")
+		}
+	case backendHTTP:
+		if c.HTTPBackend.URL == "" {
+			for _, s := range c.Services {
+				if c.ServiceConfig[s].HTTPURL == "" {
+					return fmt.Errorf("'HTTPBackend.URL' or 'ServiceConfig[%s].HTTPURL' must be set with the 'http' backend", s)
+				}
+			}
+		}
+
+		if _, err := compileJSONPath(c.HTTPBackend.Path); err != nil {
+			return fmt.Errorf("'HTTPBackend.Path' is invalid: %s", err)
+		}
+
+		if c.HTTPBackend.Interval <= 0 {
+			return errors.New("'HTTPBackend.Interval' must be positive")
+		}
+
+		if c.HTTPBackend.Timeout <= 0 {
+			return errors.New("'HTTPBackend.Timeout' must be positive")
+		}
+	default:
+		return fmt.Errorf("'Backend' %q is not a known backend", c.Backend)
+	}
+
+	if (c.HTTP.TLSCertFile == "") != (c.HTTP.TLSKeyFile == "") {
+		return errors.New("'HTTP.TLSCertFile' and 'HTTP.TLSKeyFile' must be set together")
+	}
+
+	if c.HTTP.Username != "" && c.HTTP.Password == "" {
+		return errors.New("'HTTP.Password' must be set with 'HTTP.Username'")
+	}
+
+	if c.LogLevel != "" && hclog.LevelFromString(c.LogLevel) == hclog.NoLevel {
+		return fmt.Errorf("'LogLevel' %q is not a known level", c.LogLevel)
+	}
+
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("'LogFormat' %q must be 'text' or 'json'", c.LogFormat)
+	}
+
+	if c.History.Size < 0 {
+		return errors.New("'History.Size' must not be negative")
+	}
+
+	if c.Dnstap.Enabled() {
+		n := 0
+		for _, o := range []string{c.Dnstap.Unix, c.Dnstap.TCP, c.Dnstap.File} {
+			if o != "" {
+				n++
+			}
+		}
+		if n > 1 {
+			return errors.New("only one of 'Dnstap.Unix', 'Dnstap.TCP' or 'Dnstap.File' may be set")
+		}
+
+		if c.Dnstap.BufferSize <= 0 {
+			return errors.New("'Dnstap.BufferSize' must be positive")
+		}
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return errors.New("'Tracing.SampleRatio' must be between 0 and 1")
+	}
+
+	if c.Tracing.QuerySampleRatio < 0 || c.Tracing.QuerySampleRatio > 1 {
+		return errors.New("'Tracing.QuerySampleRatio' must be between 0 and 1")
+	}
+
+	if c.Registration.Enabled {
+		if c.Registration.Name == "" {
+			return errors.New("'Registration.Name' is not set")
+		}
+
+		if c.Registration.CheckInterval <= 0 {
+			return errors.New("'Registration.CheckInterval' must be positive")
+		}
+
+		if c.Registration.CheckTimeout <= 0 {
+			return errors.New("'Registration.CheckTimeout' must be positive")
+		}
+	}
+
+	if c.Publish.Enabled && c.Publish.Prefix == "" {
+		return errors.New("'Publish.Prefix' is not set")
+	}
+
+	if c.HA.Enabled {
+		if c.HA.Prefix == "" {
+			return errors.New("'HA.Prefix' is not set")
+		}
+
+		// the bounds of Consul's session TTL
+		if c.HA.SessionTTL < time.Second*10 || c.HA.SessionTTL > time.Hour*24 {
+			return errors.New("'HA.SessionTTL' must be between 10s and 24h")
+		}
+	}
+
+	if c.Derived.Enabled {
+		if c.Derived.Suffix == "" {
+			return errors.New("'Derived.Suffix' is not set")
+		}
+
+		if c.Derived.CheckInterval <= 0 {
+			return errors.New("'Derived.CheckInterval' must be positive")
+		}
+	}
+
+	for _, n := range c.ECSTrustedNetworks {
+		if _, _, err := net.ParseCIDR(n); err != nil {
+			return fmt.Errorf("'ECSTrustedNetworks' contains invalid network %q", n)
+		}
+	}
+
+	var views []string
+	for i, v := range c.Views {
+		if v.Name == "" {
+			return fmt.Errorf("'Views[%d].Name' is not set", i)
+		}
+		views = append(views, v.Name)
+
+		if c.Backend != "" && c.Backend != backendConsul {
+			return fmt.Errorf("'Views[%d]' requires the 'consul' backend", i)
+		}
+
+		if len(v.Networks) == 0 {
+			return fmt.Errorf("'Views[%d].Networks' is not set", i)
+		}
+		for _, n := range v.Networks {
+			if _, _, err := net.ParseCIDR(n); err != nil {
+				return fmt.Errorf("'Views[%d].Networks' contains invalid network %q", i, n)
+			}
+		}
+
+		switch v.Selection {
+		case "", selectionLowest, selectionNearest:
+		case selectionLock:
+			for _, service := range c.Services {
+				if c.ServiceConfig[service].LockKey == "" {
+					return fmt.Errorf("'ServiceConfig[%s].LockKey' must be set with 'lock' selection in 'Views[%d]'", service, i)
+				}
+			}
+		default:
+			return fmt.Errorf("'Views[%d].Selection' %q is not a known selection mode", i, v.Selection)
+		}
+	}
+	if hasDuplicate(views) {
+		return errors.New("'Views' contains duplicate names")
+	}
+
+	if c.Geo.Enabled() {
+		if c.Geo.File != "" && c.Geo.MaxMindDB != "" {
+			return errors.New("only one of 'Geo.File' or 'Geo.MaxMindDB' may be set")
+		}
+
+		if c.Backend != "" && c.Backend != backendConsul {
+			return errors.New("'Geo' requires the 'consul' backend")
+		}
+
+		if c.Geo.NodeMeta == "" {
+			return errors.New("'Geo.NodeMeta' is not set")
+		}
+
+		if c.Geo.MaxMindDB != "" {
+			if _, err := compileJSONPath(c.Geo.MaxMindPath); err != nil {
+				return fmt.Errorf("'Geo.MaxMindPath' is invalid: %v", err)
+			}
+		}
+	}
+
+	for service, sc := range c.ServiceConfig {
+		if !contains(c.Services, service) {
+			return fmt.Errorf("'ServiceConfig' contains unknown service %q", service)
+		}
+
+		if sc.KubernetesService != "" {
+			if _, _, err := splitKubernetesService(sc.KubernetesService); err != nil {
+				return fmt.Errorf("'ServiceConfig[%s].KubernetesService' %q must be given as namespace/name", service, sc.KubernetesService)
+			}
+		}
+
+		if len(sc.OnChange) > 0 && sc.OnChangeTimeout <= 0 {
+			return fmt.Errorf("'ServiceConfig[%s].OnChangeTimeout' must be positive", service)
+		}
+
+		if (sc.Selection == selectionLock || sc.Selection == selectionNearest) && c.Backend != "" && c.Backend != backendConsul {
+			return fmt.Errorf("'ServiceConfig[%s].Selection' %q requires the 'consul' backend", service, sc.Selection)
+		}
+
+		// only lowest selection reads the region of each instance
+		if (sc.Selection == selectionLock || sc.Selection == selectionNearest) && c.Geo.Enabled() {
+			return fmt.Errorf("'ServiceConfig[%s].Selection' %q cannot be used with 'Geo'", service, sc.Selection)
+		}
+
+		switch sc.Selection {
+		case "", selectionLowest:
+		case selectionLock:
+			if sc.LockKey == "" {
+				return fmt.Errorf("'ServiceConfig[%s].LockKey' must be set with 'lock' selection", service)
+			}
+		case selectionNearest:
+			if sc.NearestThreshold < 0 {
+				return fmt.Errorf("'ServiceConfig[%s].NearestThreshold' must not be negative", service)
+			}
+		default:
+			return fmt.Errorf("'ServiceConfig[%s].Selection' %q is not a known selection mode", service, sc.Selection)
+		}
+
+		if p := sc.Probe; p != nil {
+			switch p.Type {
+			case probeTCP, probeTLS:
+			case probeHTTP:
+				if p.Scheme != "http" && p.Scheme != "https" {
+					return fmt.Errorf("'ServiceConfig[%s].Probe.Scheme' must be 'http' or 'https'", service)
+				}
+			case probeDNS:
+				if p.QueryName == "" {
+					return fmt.Errorf("'ServiceConfig[%s].Probe.QueryName' must be set with 'dns' probes", service)
+				}
+			default:
+				return fmt.Errorf("'ServiceConfig[%s].Probe.Type' %q is not a known probe type", service, p.Type)
+			}
+
+			if p.Port < 1 || p.Port > 65535 {
+				return fmt.Errorf("'ServiceConfig[%s].Probe.Port' must be between 1 and 65535", service)
+			}
+			if p.Interval <= 0 {
+				return fmt.Errorf("'ServiceConfig[%s].Probe.Interval' must be positive", service)
+			}
+			if p.Timeout <= 0 || p.Timeout > p.Interval {
+				return fmt.Errorf("'ServiceConfig[%s].Probe.Timeout' must be positive and no greater than 'Interval'", service)
+			}
+			if p.Rise < 1 || p.Fall < 1 {
+				return fmt.Errorf("'ServiceConfig[%s].Probe.Rise' and 'Fall' must be at least 1", service)
+			}
+		}
+	}
+
+	for i, w := range c.Webhooks {
+		if w.URL == "" {
+			return fmt.Errorf("'Webhooks[%d].URL' is not set", i)
+		}
+
+		if _, ok := webhookTemplates[w.Template]; !ok {
+			return fmt.Errorf("'Webhooks[%d].Template' %q is not a known template", i, w.Template)
+		}
+
+		if w.Timeout <= 0 {
+			return fmt.Errorf("'Webhooks[%d].Timeout' must be positive", i)
+		}
+
+		if w.QueueSize <= 0 {
+			return fmt.Errorf("'Webhooks[%d].QueueSize' must be positive", i)
+		}
+
+		for _, s := range w.Services {
+			if !contains(c.Services, s) {
+				return fmt.Errorf("'Webhooks[%d].Services' contains unknown service %q", i, s)
+			}
+		}
+	}
+
 	return nil
 }
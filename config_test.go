@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
 func TestConfig_Validate(t *testing.T) {
@@ -111,3 +112,217 @@ func TestConfig_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_Validate_selection(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   string
+		selection string
+		geo       bool
+		wantErr   bool
+	}{
+		{
+			"lock with consul backend",
+			backendConsul,
+			selectionLock,
+			false,
+			false,
+		},
+		{
+			"lock with file backend",
+			backendFile,
+			selectionLock,
+			false,
+			true,
+		},
+		{
+			"nearest with default backend",
+			"",
+			selectionNearest,
+			false,
+			false,
+		},
+		{
+			"nearest with etcd backend",
+			backendEtcd,
+			selectionNearest,
+			false,
+			true,
+		},
+		{
+			"lowest with file backend",
+			backendFile,
+			selectionLowest,
+			false,
+			false,
+		},
+		{
+			"lock with geo",
+			backendConsul,
+			selectionLock,
+			true,
+			true,
+		},
+		{
+			"nearest with geo",
+			backendConsul,
+			selectionNearest,
+			true,
+			true,
+		},
+		{
+			"lowest with geo",
+			backendConsul,
+			selectionLowest,
+			true,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Bind:     ":5300",
+				PromBind: ":5301",
+				Zone:     "foo",
+				Services: []string{"bar"},
+				Backend:  tt.backend,
+				File:     FileConfig{Path: "/dev/null", PollInterval: time.Second},
+				Etcd:     EtcdConfig{Endpoints: []string{"127.0.0.1:2379"}},
+				ServiceConfig: map[string]ServiceConfig{
+					"bar": {Selection: tt.selection, LockKey: "locks/bar"},
+				},
+			}
+			if tt.geo {
+				c.Geo = GeoConfig{File: "/dev/null", NodeMeta: "region"}
+			}
+
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_kubernetesService(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		wantErr bool
+	}{
+		{
+			"namespace and name",
+			"default/web",
+			false,
+		},
+		{
+			"name only",
+			"web",
+			true,
+		},
+		{
+			"empty namespace",
+			"/web",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Bind:     ":5300",
+				PromBind: ":5301",
+				Zone:     "foo",
+				Services: []string{"bar"},
+				Backend:  backendKubernetes,
+				Kubernetes: KubernetesConfig{
+					Namespace: "default",
+				},
+				ServiceConfig: map[string]ServiceConfig{
+					"bar": {KubernetesService: tt.service},
+				},
+			}
+
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_nearestThreshold(t *testing.T) {
+	c := &Config{
+		ServiceConfig: map[string]ServiceConfig{
+			"bar": {NearestThreshold: time.Millisecond * 20},
+			"baz": {},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		service string
+		want    time.Duration
+	}{
+		{
+			"configured",
+			"bar",
+			time.Millisecond * 20,
+		},
+		{
+			"zero threshold",
+			"baz",
+			defaultNearestThreshold,
+		},
+		{
+			"no service config",
+			"qux",
+			defaultNearestThreshold,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.nearestThreshold(tt.service); got != tt.want {
+				t.Errorf("Config.nearestThreshold() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_webhookTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{
+			"positive timeout",
+			time.Second * 5,
+			false,
+		},
+		{
+			"zero timeout",
+			0,
+			true,
+		},
+		{
+			"negative timeout",
+			-time.Second,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Bind:     ":5300",
+				PromBind: ":5301",
+				Zone:     "foo",
+				Services: []string{"bar"},
+				Webhooks: []WebhookConfig{
+					{URL: "http://127.0.0.1:8080/hook", Template: "json", Timeout: tt.timeout, QueueSize: 10},
+				},
+			}
+
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// Coordinator elects a leader for each service among a group of hobson
+// instances, using a Consul session lock. The leader selects the service's
+// record and publishes it; other instances serve the published record. If
+// the published record cannot be read, instances fall back to selecting
+// the lowest healthy record locally.
+type Coordinator struct {
+	config   HAConfig
+	services []string
+	instance string
+
+	client    *api.Client
+	kv        kvClient
+	publisher *Publisher
+	handler   *DNSHandler
+
+	mu      sync.RWMutex
+	leading map[string]bool
+
+	// transitionMu serializes changes of leadership with serving published
+	// records, so that a leader never serves a published record
+	transitionMu sync.Mutex
+
+	// acquire acquires the lock for a service, returning a channel closed
+	// if the lock is lost and a function releasing the lock. The channel
+	// is nil if stopCh was closed before the lock was acquired.
+	acquire func(service string, stopCh <-chan struct{}) (<-chan struct{}, func() error, error)
+
+	logger hclog.Logger
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	shutdownCh chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewCoordinator creates a new Coordinator object for a set of services
+// served by a given DNSHandler
+func NewCoordinator(config HAConfig, services []string, h *DNSHandler, logger hclog.Logger) (*Coordinator, error) {
+	client, err := api.NewClient(api.DefaultConfigWithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+
+	instance := config.Instance
+	if instance == "" {
+		instance = instanceID(defaultRegistrationName)
+	}
+
+	publisher, err := NewPublisher(PublishConfig{
+		Prefix:   path.Join(config.Prefix, "selections"),
+		Instance: instance,
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Coordinator{
+		config:     config,
+		services:   services,
+		instance:   instance,
+		client:     client,
+		kv:         client.KV(),
+		publisher:  publisher,
+		handler:    h,
+		leading:    make(map[string]bool),
+		logger:     logger.With("instance", instance),
+		ctx:        ctx,
+		cancel:     cancel,
+		shutdownCh: make(chan struct{}),
+	}
+	c.acquire = c.lock
+
+	return c, nil
+}
+
+// RecordChanged implements ChangeListener. Changes are published only for
+// services this instance leads.
+func (c *Coordinator) RecordChanged(rc *RecordChange) {
+	if !c.Leading(rc.Service) || rc.Reason == ReasonLeader {
+		return
+	}
+
+	c.publisher.RecordChanged(rc)
+}
+
+// Leading returns true if this instance is the leader for a service
+func (c *Coordinator) Leading(service string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.leading[service]
+}
+
+func (c *Coordinator) setLeading(service string, leading bool) {
+	c.mu.Lock()
+	c.leading[service] = leading
+	c.mu.Unlock()
+
+	v := 0.0
+	if leading {
+		v = 1
+	}
+	haLeader.WithLabelValues(service).Set(v)
+}
+
+// Run spawns goroutines to contend for leadership of, and follow the
+// published record of, each service
+func (c *Coordinator) Run() {
+	c.publisher.Run()
+
+	for _, service := range c.services {
+		c.wg.Add(2)
+		go c.lead(service)
+		go c.follow(service)
+	}
+}
+
+// lead repeatedly acquires the lock for a service. While the lock is held,
+// this instance selects and publishes the service's record.
+func (c *Coordinator) lead(service string) {
+	defer c.wg.Done()
+
+	logger := c.logger.With("service", service)
+
+	var attempt uint64
+	for {
+		lostCh, release, err := c.acquire(service, c.shutdownCh)
+		if err != nil {
+			logger.Error("Failed to acquire leadership", "error", err)
+
+			attempt++
+			select {
+			case <-c.shutdownCh:
+				return
+			case <-time.After(backoffDuration(attempt)):
+			}
+			continue
+		}
+		attempt = 0
+
+		if lostCh == nil {
+			return
+		}
+
+		logger.Info("Acquired leadership")
+		c.becomeLeader(service)
+
+		select {
+		case <-lostCh:
+			logger.Warn("Lost leadership")
+			c.transition(service, false)
+		case <-c.shutdownCh:
+			c.transition(service, false)
+			if err := release(); err != nil {
+				logger.Error("Failed to release leadership", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// lock acquires the Consul lock for a service
+func (c *Coordinator) lock(service string, stopCh <-chan struct{}) (<-chan struct{}, func() error, error) {
+	lock, err := c.client.LockOpts(&api.LockOptions{
+		Key:         path.Join(c.config.Prefix, "locks", service),
+		Value:       []byte(c.instance),
+		SessionName: "hobson " + service,
+		SessionTTL:  c.config.SessionTTL.String(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lostCh, err := lock.Lock(stopCh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return lostCh, lock.Unlock, nil
+}
+
+// becomeLeader marks this instance as the leader of a service, reselects
+// the service's record locally, preferring the record published by the
+// previous leader, and publishes the result
+func (c *Coordinator) becomeLeader(service string) {
+	c.transitionMu.Lock()
+	defer c.transitionMu.Unlock()
+
+	c.setLeading(service, true)
+
+	// a change of address is published by RecordChanged
+	if rc := c.handler.Unfollow(service); rc != nil && rc.OldAddress != rc.NewAddress {
+		return
+	}
+
+	if address := c.handler.Selected(service); address != "" {
+		c.publisher.RecordChanged(&RecordChange{
+			Time:       time.Now(),
+			Service:    service,
+			NewAddress: address,
+			Reason:     ReasonLeader,
+		})
+	}
+}
+
+// transition sets whether this instance leads a service
+func (c *Coordinator) transition(service string, leading bool) {
+	c.transitionMu.Lock()
+	defer c.transitionMu.Unlock()
+
+	c.setLeading(service, leading)
+}
+
+// follow watches the record published for a service, serving it while
+// this instance is not the leader
+func (c *Coordinator) follow(service string) {
+	defer c.wg.Done()
+
+	logger := c.logger.With("service", service)
+	key := path.Join(c.config.Prefix, "selections", service)
+
+	var index, attempt uint64
+	for {
+		pair, meta, err := c.kv.Get(key, (&api.QueryOptions{WaitIndex: index}).WithContext(c.ctx))
+		if c.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to fetch published record, falling back to local selection", "error", err)
+			c.apply(service, nil)
+
+			attempt++
+			select {
+			case <-c.shutdownCh:
+				return
+			case <-time.After(backoffDuration(attempt)):
+			}
+			continue
+		}
+		attempt = 0
+		index = meta.LastIndex
+
+		c.apply(service, pair)
+	}
+}
+
+// apply serves the record in a published pair, unless this instance leads
+// the service. Services with no valid published record are selected locally.
+func (c *Coordinator) apply(service string, pair *api.KVPair) {
+	c.transitionMu.Lock()
+	defer c.transitionMu.Unlock()
+
+	if c.Leading(service) {
+		return
+	}
+
+	if pair == nil {
+		c.handler.Fallback(service)
+		return
+	}
+
+	var s Selection
+	if err := json.Unmarshal(pair.Value, &s); err != nil {
+		c.logger.Error("Invalid published record, falling back to local selection", "service", service, "error", err)
+		c.handler.Fallback(service)
+		return
+	}
+
+	if err := c.handler.Follow(service, s.Address); err != nil {
+		c.logger.Error("Invalid published record, falling back to local selection", "service", service, "error", err)
+		c.handler.Fallback(service)
+	}
+}
+
+// Shutdown releases any held leadership and ends coordination
+func (c *Coordinator) Shutdown(ctx context.Context) error {
+	close(c.shutdownCh)
+	c.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+
+	return c.publisher.Shutdown(ctx)
+}
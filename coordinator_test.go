@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestCoordinator_apply(t *testing.T) {
+	tests := []struct {
+		name    string
+		leading bool
+		pair    *api.KVPair
+		want    string
+	}{
+		{
+			"published record",
+			false,
+			selectionPair("127.0.0.2"),
+			"127.0.0.2",
+		},
+		{
+			"leader ignores published record",
+			true,
+			selectionPair("127.0.0.2"),
+			"127.0.0.1",
+		},
+		{
+			"no published record",
+			false,
+			nil,
+			"127.0.0.1",
+		},
+		{
+			"invalid published record",
+			false,
+			&api.KVPair{Key: "hobson/ha/selections/bar", Value: []byte("nope")},
+			"127.0.0.1",
+		},
+		{
+			"invalid published address",
+			false,
+			selectionPair("nope"),
+			"127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewDNSHandler("foo", hclog.NewNullLogger())
+			h.UpdateRecord("bar", []string{"127.0.0.1", "127.0.0.2"})
+
+			// a previously followed record, which must be replaced
+			h.Follow("bar", "127.0.0.3")
+			if tt.leading {
+				h.Unfollow("bar")
+			}
+
+			c := &Coordinator{
+				handler: h,
+				leading: map[string]bool{"bar": tt.leading},
+				logger:  hclog.NewNullLogger(),
+			}
+			c.apply("bar", tt.pair)
+
+			if got := h.Selected("bar"); got != tt.want {
+				t.Errorf("Coordinator.apply() served %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoordinator_RecordChanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		leading bool
+		reason  ChangeReason
+		want    int
+	}{
+		{
+			"leader publishes change",
+			true,
+			ReasonUnhealthy,
+			1,
+		},
+		{
+			"follower does not publish change",
+			false,
+			ReasonUnhealthy,
+			0,
+		},
+		{
+			"leader does not republish followed record",
+			true,
+			ReasonLeader,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Publisher{
+				queue:  make(chan *RecordChange, 1),
+				logger: hclog.NewNullLogger(),
+			}
+			c := &Coordinator{
+				publisher: p,
+				leading:   map[string]bool{"bar": tt.leading},
+			}
+
+			c.RecordChanged(&RecordChange{
+				Service:    "bar",
+				OldAddress: "127.0.0.1",
+				NewAddress: "127.0.0.2",
+				Reason:     tt.reason,
+			})
+
+			if got := len(p.queue); got != tt.want {
+				t.Errorf("Coordinator.RecordChanged() queued %d changes, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoordinator_lead(t *testing.T) {
+	tests := []struct {
+		name       string
+		followed   string
+		want       string
+		wantReason ChangeReason
+	}{
+		{
+			"keeps healthy published record",
+			"127.0.0.2",
+			"127.0.0.2",
+			ReasonLeader,
+		},
+		{
+			"reselects unhealthy published record",
+			"127.0.0.3",
+			"127.0.0.1",
+			ReasonFailback,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewDNSHandler("foo", hclog.NewNullLogger())
+			h.UpdateRecord("bar", []string{"127.0.0.1", "127.0.0.2"})
+			h.Follow("bar", tt.followed)
+
+			p := &Publisher{
+				queue:  make(chan *RecordChange, 4),
+				logger: hclog.NewNullLogger(),
+			}
+
+			lockCh := make(chan chan struct{})
+			c := &Coordinator{
+				handler:    h,
+				publisher:  p,
+				leading:    make(map[string]bool),
+				logger:     hclog.NewNullLogger(),
+				shutdownCh: make(chan struct{}),
+				acquire: func(service string, stopCh <-chan struct{}) (<-chan struct{}, func() error, error) {
+					select {
+					case lostCh := <-lockCh:
+						return lostCh, func() error { return nil }, nil
+					case <-stopCh:
+						return nil, nil, nil
+					}
+				},
+			}
+			h.AddListener(c)
+
+			c.wg.Add(1)
+			go c.lead("bar")
+
+			lostCh := make(chan struct{})
+			lockCh <- lostCh
+
+			select {
+			case rc := <-p.queue:
+				if rc.NewAddress != tt.want || rc.Reason != tt.wantReason {
+					t.Errorf("Coordinator.lead() published %v (%v), want %v (%v)", rc.NewAddress, rc.Reason, tt.want, tt.wantReason)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Coordinator.lead() did not publish a record")
+			}
+
+			if !c.Leading("bar") {
+				t.Error("Coordinator.lead() expected leadership")
+			}
+			if got := h.Selected("bar"); got != tt.want {
+				t.Errorf("Coordinator.lead() served %v, want %v", got, tt.want)
+			}
+
+			// the leader does not serve published records
+			c.apply("bar", selectionPair("127.0.0.4"))
+			if got := h.Selected("bar"); got != tt.want {
+				t.Errorf("Coordinator.apply() as leader served %v, want %v", got, tt.want)
+			}
+
+			close(lostCh)
+			waitFor(t, func() bool { return !c.Leading("bar") })
+
+			if got := len(p.queue); got != 0 {
+				t.Errorf("Coordinator.lead() published %d more records, want 0", got)
+			}
+
+			c.apply("bar", selectionPair("127.0.0.4"))
+			if got := h.Selected("bar"); got != "127.0.0.4" {
+				t.Errorf("Coordinator.apply() after losing leadership served %v, want 127.0.0.4", got)
+			}
+
+			close(c.shutdownCh)
+			c.wg.Wait()
+		})
+	}
+}
+
+// MockWatchKV is a kvClient whose Get calls return queued results, blocking
+// until a result is queued or the query's context is done
+type MockWatchKV struct {
+	results chan mockKVResult
+}
+
+type mockKVResult struct {
+	pair *api.KVPair
+	err  error
+}
+
+func (m *MockWatchKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	select {
+	case r := <-m.results:
+		return r.pair, &api.QueryMeta{LastIndex: q.WaitIndex + 1}, r.err
+	case <-q.Context().Done():
+		return nil, nil, q.Context().Err()
+	}
+}
+
+func (m *MockWatchKV) CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	return false, nil, errors.New("not implemented")
+}
+
+func TestCoordinator_follow(t *testing.T) {
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.UpdateRecord("bar", []string{"127.0.0.2"})
+	h.UpdateRecord("bar", []string{"127.0.0.1", "127.0.0.2"})
+
+	kv := &MockWatchKV{results: make(chan mockKVResult)}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Coordinator{
+		config:     HAConfig{Prefix: "hobson/ha"},
+		handler:    h,
+		kv:         kv,
+		leading:    make(map[string]bool),
+		logger:     hclog.NewNullLogger(),
+		ctx:        ctx,
+		cancel:     cancel,
+		shutdownCh: make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go c.follow("bar")
+
+	kv.results <- mockKVResult{pair: selectionPair("127.0.0.2")}
+	waitFor(t, func() bool { return h.Selected("bar") == "127.0.0.2" })
+
+	// the local selection was sticky to 127.0.0.2, but falling back
+	// selects the lowest healthy record
+	kv.results <- mockKVResult{err: errors.New("unreachable")}
+	waitFor(t, func() bool { return h.Selected("bar") == "127.0.0.1" })
+
+	kv.results <- mockKVResult{pair: selectionPair("127.0.0.3")}
+	waitFor(t, func() bool { return h.Selected("bar") == "127.0.0.3" })
+
+	close(c.shutdownCh)
+	cancel()
+	c.wg.Wait()
+}
+
+func selectionPair(address string) *api.KVPair {
+	b, _ := json.Marshal(Selection{Address: address, SelectedAt: time.Now(), Instance: "other"})
+	return &api.KVPair{Key: "hobson/ha/selections/bar", Value: b}
+}
+
+// waitFor fails a test if a condition does not become true within a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
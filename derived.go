@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+const derivedQueueSize = 100
+
+// agentClient is the subset of the Consul agent API used by a Deriver
+type agentClient interface {
+	ServiceRegister(service *api.AgentServiceRegistration) error
+	ServiceDeregister(serviceID string) error
+	UpdateTTL(checkID, output, status string) error
+}
+
+// Deriver maintains a Consul service registration for each service, such
+// as web-primary for web, whose address is the service's selected record
+type Deriver struct {
+	config DerivedConfig
+
+	agent agentClient
+	queue chan *RecordChange
+
+	// registered tracks the ID of each derived service, and is only
+	// accessed by the Run goroutine until shutdown
+	registered map[string]string
+
+	logger hclog.Logger
+
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+// NewDeriver creates a new Deriver object for a given configuration
+func NewDeriver(config DerivedConfig, logger hclog.Logger) (*Deriver, error) {
+	client, err := api.NewClient(api.DefaultConfigWithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Deriver{
+		config:     config,
+		agent:      client.Agent(),
+		queue:      make(chan *RecordChange, derivedQueueSize),
+		registered: make(map[string]string),
+		logger:     logger,
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}, nil
+}
+
+// RecordChanged implements ChangeListener. Changes that leave the served
+// address in place are not registered, and changes are dropped if the queue
+// is full.
+func (d *Deriver) RecordChanged(c *RecordChange) {
+	if c.OldAddress == c.NewAddress {
+		return
+	}
+
+	select {
+	case d.queue <- c:
+	default:
+		d.logger.Warn("Derived service queue is full, dropping change", "service", c.Service, "address", c.NewAddress)
+		derivedRegistration.WithLabelValues(c.Service, "dropped").Inc()
+	}
+}
+
+// Run spawns a goroutine to register queued changes, and to pass the check
+// of each derived service every CheckInterval. Failed registrations are
+// retried with an exponential backoff until they succeed, or are replaced by
+// a later change to the same service.
+func (d *Deriver) Run() {
+	go func() {
+		defer close(d.doneCh)
+
+		t := time.NewTicker(d.config.CheckInterval)
+		defer t.Stop()
+
+		pending := make(map[string]*RecordChange)
+		var attempt uint64
+		var retryCh <-chan time.Time
+
+		for {
+			select {
+			case <-d.shutdownCh:
+				return
+			case <-t.C:
+				d.passChecks()
+				continue
+			case c := <-d.queue:
+				pending[c.Service] = c
+				if retryCh != nil {
+					continue
+				}
+			case <-retryCh:
+				retryCh = nil
+			}
+
+			if d.registerPending(pending) {
+				attempt = 0
+				continue
+			}
+
+			attempt++
+			retryCh = time.After(backoffDuration(attempt))
+		}
+	}()
+}
+
+// registerPending registers each pending change, removing those that were
+// registered. It returns true if every change was registered.
+func (d *Deriver) registerPending(pending map[string]*RecordChange) bool {
+	ok := true
+	for service, c := range pending {
+		if err := d.register(c); err != nil {
+			d.logger.Error("Failed to register derived service", "service", service, "error", err)
+			derivedRegistration.WithLabelValues(service, "failed").Inc()
+			ok = false
+			continue
+		}
+
+		derivedRegistration.WithLabelValues(service, "registered").Inc()
+		delete(pending, service)
+	}
+
+	return ok
+}
+
+// passChecks passes the check of each registered derived service
+func (d *Deriver) passChecks() {
+	for service, id := range d.registered {
+		if err := d.agent.UpdateTTL(derivedCheckID(id), "", api.HealthPassing); err != nil {
+			d.logger.Error("Failed to update derived service check", "service", service, "error", err)
+		}
+	}
+}
+
+func derivedCheckID(id string) string {
+	return "service:" + id
+}
+
+// register registers the derived service for a change. Registrations have
+// no port, as hobson tracks only the addresses of instances. Their TTL
+// check is registered passing, and becomes critical if hobson stops
+// passing it without deregistering the service, such as after a crash.
+func (d *Deriver) register(c *RecordChange) error {
+	name := c.Service + d.config.Suffix
+	id := "hobson-" + name
+
+	err := d.agent.ServiceRegister(&api.AgentServiceRegistration{
+		ID:      id,
+		Name:    name,
+		Address: c.NewAddress,
+		Tags:    d.config.Tags,
+		Meta: map[string]string{
+			"hobson_service": c.Service,
+			"hobson_reason":  string(c.Reason),
+		},
+		Check: &api.AgentServiceCheck{
+			CheckID: derivedCheckID(id),
+			Name:    "hobson selection",
+			TTL:     (d.config.CheckInterval * 3).String(),
+			Status:  api.HealthPassing,
+			Notes:   fmt.Sprintf("Updated every %s while hobson selects the record for %s", d.config.CheckInterval, c.Service),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	d.logger.Info("Registered derived service", "name", name, "address", c.NewAddress)
+	d.registered[c.Service] = id
+	return nil
+}
+
+// Shutdown ends registration, and deregisters all derived services
+func (d *Deriver) Shutdown(ctx context.Context) error {
+	close(d.shutdownCh)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.doneCh:
+	}
+
+	var err error
+	for service, id := range d.registered {
+		if derr := d.agent.ServiceDeregister(id); derr != nil {
+			d.logger.Error("Failed to deregister derived service", "service", service, "error", derr)
+			err = derr
+		}
+	}
+
+	return err
+}
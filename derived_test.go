@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// MockAgent is an in-memory agentClient. If failures is positive, that many
+// registrations fail.
+type MockAgent struct {
+	mu       sync.Mutex
+	services map[string]*api.AgentServiceRegistration
+	checks   map[string]int
+	failures int
+}
+
+func NewMockAgent() *MockAgent {
+	return &MockAgent{
+		services: make(map[string]*api.AgentServiceRegistration),
+		checks:   make(map[string]int),
+	}
+}
+
+func (m *MockAgent) ServiceRegister(service *api.AgentServiceRegistration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("agent unavailable")
+	}
+
+	m.services[service.ID] = service
+	return nil
+}
+
+func (m *MockAgent) ServiceDeregister(serviceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.services, serviceID)
+	return nil
+}
+
+func (m *MockAgent) UpdateTTL(checkID, output, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if status == api.HealthPassing {
+		m.checks[checkID]++
+	}
+	return nil
+}
+
+// passes returns the number of times a check was passed
+func (m *MockAgent) passes(checkID string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.checks[checkID]
+}
+
+func (m *MockAgent) service(id string) *api.AgentServiceRegistration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.services[id]
+}
+
+func TestDeriver_RecordChanged(t *testing.T) {
+	agent := NewMockAgent()
+	d := &Deriver{
+		config:     DerivedConfig{Suffix: "-primary", CheckInterval: time.Hour},
+		agent:      agent,
+		queue:      make(chan *RecordChange, 1),
+		registered: make(map[string]string),
+		logger:     hclog.NewNullLogger(),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	d.Run()
+
+	changes := []*RecordChange{
+		{Service: "web", NewAddress: "10.0.0.1", Reason: ReasonInitial},
+		{Service: "web", OldAddress: "10.0.0.1", NewAddress: "10.0.0.1", Reason: ReasonEmptyPool},
+		{Service: "web", OldAddress: "10.0.0.1", NewAddress: "10.0.0.2", Reason: ReasonUnhealthy},
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for _, c := range changes {
+		d.RecordChanged(c)
+
+		for len(d.queue) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	var s *api.AgentServiceRegistration
+	for time.Now().Before(deadline) {
+		if s = agent.service("hobson-web-primary"); s != nil && s.Address == "10.0.0.2" {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if s == nil {
+		t.Fatalf("RecordChanged() did not register derived service")
+	}
+	if s.Name != "web-primary" {
+		t.Errorf("RecordChanged() registered name = %v, want web-primary", s.Name)
+	}
+	if s.Address != "10.0.0.2" {
+		t.Errorf("RecordChanged() registered address = %v, want 10.0.0.2", s.Address)
+	}
+	if s.Meta["hobson_reason"] != string(ReasonUnhealthy) {
+		t.Errorf("RecordChanged() registered reason = %v, want %v", s.Meta["hobson_reason"], ReasonUnhealthy)
+	}
+
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if s := agent.service("hobson-web-primary"); s != nil {
+		t.Errorf("Shutdown() did not deregister derived service")
+	}
+}
+
+func TestDeriver_retry(t *testing.T) {
+	agent := NewMockAgent()
+	agent.failures = 1
+
+	d := &Deriver{
+		config:     DerivedConfig{Suffix: "-primary", CheckInterval: time.Hour},
+		agent:      agent,
+		queue:      make(chan *RecordChange, 1),
+		registered: make(map[string]string),
+		logger:     hclog.NewNullLogger(),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	d.Run()
+
+	d.RecordChanged(&RecordChange{Service: "web", NewAddress: "10.0.0.1", Reason: ReasonInitial})
+
+	deadline := time.Now().Add(time.Second * 3)
+	for agent.service("hobson-web-primary") == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if agent.service("hobson-web-primary") == nil {
+		t.Errorf("Run() did not retry failed registration")
+	}
+
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+}
+
+func TestDeriver_check(t *testing.T) {
+	agent := NewMockAgent()
+
+	d := &Deriver{
+		config:     DerivedConfig{Suffix: "-primary", CheckInterval: time.Millisecond * 10},
+		agent:      agent,
+		queue:      make(chan *RecordChange, 1),
+		registered: make(map[string]string),
+		logger:     hclog.NewNullLogger(),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	d.Run()
+
+	d.RecordChanged(&RecordChange{Service: "web", NewAddress: "10.0.0.1", Reason: ReasonInitial})
+
+	deadline := time.Now().Add(time.Second * 3)
+	for agent.passes("service:hobson-web-primary") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if agent.passes("service:hobson-web-primary") == 0 {
+		t.Errorf("Run() did not pass the derived service check")
+	}
+
+	s := agent.service("hobson-web-primary")
+	if s == nil || s.Check == nil {
+		t.Fatalf("RecordChanged() registered %+v, want a service with a check", s)
+	}
+	if s.Check.TTL != "30ms" || s.Check.Status != api.HealthPassing {
+		t.Errorf("RecordChanged() check TTL = %v, status = %v, want 30ms, passing", s.Check.TTL, s.Check.Status)
+	}
+
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+}
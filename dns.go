@@ -4,20 +4,102 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log"
 	"net"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // RecordEntry associated a set of DNS records with a given Consul service
 type RecordEntry struct {
 	addresses []string
 	service   string
+
+	// changed and checkChanged are used to measure the time taken for a
+	// change in the backend to be reflected in the served record
+	changed      time.Time
+	checkChanged time.Time
+
+	// reason overrides the reason reported if the served record changes
+	reason ChangeReason
+
+	// regions maps addresses to the region of their instance
+	regions map[string]string
+
+	// ordered is true if addresses are in order of preference
+	ordered bool
+
+	// spanContext links the record update to the fetch that produced it
+	spanContext trace.SpanContext
+}
+
+// ChangeReason describes why the record served for a service changed
+type ChangeReason string
+
+const (
+	// ReasonInitial is used when a service is assigned its first record
+	ReasonInitial ChangeReason = "initial"
+	// ReasonUnhealthy is used when the current record is no longer healthy
+	ReasonUnhealthy ChangeReason = "current_unhealthy"
+	// ReasonFailback is used when a service returns to its previous record
+	ReasonFailback ChangeReason = "failback"
+	// ReasonManualPin is used when a record is pinned by an operator
+	ReasonManualPin ChangeReason = "manual_pin"
+	// ReasonEmptyPool is used when a service has no healthy records. The
+	// current record continues to be served.
+	ReasonEmptyPool ChangeReason = "empty_pool"
+	// ReasonNearer is used when a closer record is selected by nearest
+	// selection
+	ReasonNearer ChangeReason = "nearer"
+	// ReasonLeader is used when a record is selected by the leader of a
+	// group of coordinated instances
+	ReasonLeader ChangeReason = "leader"
+	// ReasonFallback is used when an instance that cannot serve the leader's
+	// record selects the lowest healthy record locally
+	ReasonFallback ChangeReason = "local_fallback"
+)
+
+// failover returns true if a change for this reason moves the record to a
+// different instance because of the instances' health or distance
+func (r ChangeReason) failover() bool {
+	return r == ReasonUnhealthy || r == ReasonFailback || r == ReasonNearer
+}
+
+// RecordChange describes a change to the record served for a service
+type RecordChange struct {
+	Time       time.Time    `json:"time"`
+	Service    string       `json:"service"`
+	OldAddress string       `json:"old_address"`
+	NewAddress string       `json:"new_address"`
+	Healthy    []string     `json:"healthy"`
+	Reason     ChangeReason `json:"reason"`
+	View       string       `json:"view,omitempty"`
+	Region     string       `json:"region,omitempty"`
+}
+
+// ChangeListener is notified of every change to the records served by a
+// DNSHandler. RecordChanged may be called from multiple goroutines, and
+// must not block.
+type ChangeListener interface {
+	RecordChanged(*RecordChange)
+}
+
+// recordState tracks the selection history of a single service
+type recordState struct {
+	healthy   []string
+	ordered   bool
+	previous  string
+	pinned    bool
+	following bool
+	empty     bool
 }
 
 // DNSHandler stores DNS record information for monitored Consul services, and implement
@@ -27,7 +109,29 @@ type DNSHandler struct {
 
 	zone string
 
-	svcMap map[string]net.IP
+	// view is the name of the View served by this handler, if any, and
+	// views are the Views to which queries from their networks are passed
+	view  string
+	views []*View
+
+	// region is the name of the region served by this handler, if any.
+	// If locator is set, queries from clients in a region are answered by
+	// the handler for that region in regions.
+	region          string
+	locator         Locator
+	regions         map[string]*DNSHandler
+	regionListeners []ChangeListener
+
+	// ecsTrusted are the networks from which EDNS Client Subnet options
+	// are honored
+	ecsTrusted []*net.IPNet
+
+	svcMap  map[string]net.IP
+	records map[string]*recordState
+
+	listeners []ChangeListener
+
+	logger hclog.Logger
 
 	shutdownCh chan struct{}
 }
@@ -38,30 +142,71 @@ func NewDNSServer(bind string) *dns.Server {
 }
 
 // NewDNSHandler creates a new DNSHandler object for a given zone
-func NewDNSHandler(zone string) *DNSHandler {
+func NewDNSHandler(zone string, logger hclog.Logger) *DNSHandler {
 	return &DNSHandler{
 		zone:       zone,
 		svcMap:     make(map[string]net.IP),
+		records:    make(map[string]*recordState),
+		logger:     logger,
 		shutdownCh: make(chan struct{}),
 	}
 }
 
 // ServeDNS implements dns.ServeDNS, which responds to DNS queries
-// on a given dns.Server
+// on a given dns.Server. Queries are answered by the View containing the
+// client, if any.
 func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	c := queryClient(w.RemoteAddr(), r, h.ecsTrusted)
+	c.scope = ecsScope(c, h.viewNetworks())
+
+	if v := h.viewFor(c.ip); v != nil {
+		v.handler.serve(w, r, c)
+		return
+	}
+
+	if h.locator != nil && c.ip != nil {
+		region, bits := h.locator.Locate(c.ip)
+		if c.hasSubnet() && uint8(bits) > c.scope {
+			c.scope = uint8(bits)
+		}
+
+		if rh := h.regionHandlerFor(region, r.Question[0].Name); rh != nil {
+			rh.serve(w, r, c)
+			return
+		}
+	}
+
+	h.serve(w, r, c)
+}
+
+// serve answers a query from a given client
+func (h *DNSHandler) serve(w dns.ResponseWriter, r *dns.Msg, c *dnsClient) {
 	timer := prometheus.NewTimer(queryHandleDuration)
 	defer timer.ObserveDuration()
 
 	msg := dns.Msg{}
 	msg.SetReply(r)
+	domain := msg.Question[0].Name
+
+	_, span := tracer().Start(context.Background(), spanQuery, trace.WithAttributes(
+		attribute.String("dns.name", domain),
+		attribute.String("dns.qtype", dns.TypeToString[r.Question[0].Qtype]),
+	))
+	defer span.End()
+
+	h.mu.RLock()
+	address, ok := h.svcMap[domain]
+	h.mu.RUnlock()
+
+	service := unknownServiceLabel
+	if ok {
+		service = h.metricService(strings.TrimSuffix(domain, "."+h.zone+"."))
+	}
+
 	switch r.Question[0].Qtype {
 	case dns.TypeA:
 		msg.Authoritative = true
-		domain := msg.Question[0].Name
 
-		h.mu.RLock()
-		address, ok := h.svcMap[domain]
-		h.mu.RUnlock()
 		if !ok {
 			queryUnknownName.Inc()
 			msg.SetRcode(r, dns.RcodeNameError)
@@ -77,8 +222,23 @@ func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 			},
 			A: address,
 		})
-		recordServed.WithLabelValues(strings.Split(domain, ".")[0]).Inc() // TODO clean this up
+		recordServed.WithLabelValues(service).Inc()
 	}
+
+	queryTotal.WithLabelValues(service, qtypeLabel(r.Question[0].Qtype), dns.RcodeToString[msg.Rcode]).Inc()
+	span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[msg.Rcode]))
+
+	if h.logger.IsDebug() {
+		h.logger.Debug("Answering query",
+			"client", w.RemoteAddr().String(),
+			"name", r.Question[0].Name,
+			"qtype", dns.TypeToString[r.Question[0].Qtype],
+			"rcode", dns.RcodeToString[msg.Rcode],
+			"answers", len(msg.Answer),
+		)
+	}
+
+	setEdns0(&msg, r, c)
 	w.WriteMsg(&msg)
 }
 
@@ -94,11 +254,16 @@ func (h *DNSHandler) Watch(notify <-chan *RecordEntry) {
 				t := a.addresses
 
 				if len(t) == 0 {
-					log.Printf("No records for service %q", a.service)
-					continue
+					h.logger.Warn("No records for service", "service", a.service)
 				}
 
-				h.UpdateRecord(a.service, t)
+				ctx := trace.ContextWithSpanContext(context.Background(), a.spanContext)
+				c := h.update(ctx, a.service, t, a.reason, a.ordered)
+				if c != nil && c.OldAddress != "" && c.OldAddress != c.NewAddress {
+					observePropagation(h.metricService(a.service), a, c.Time)
+				}
+
+				h.updateRegions(ctx, a)
 			}
 		}
 	}()
@@ -110,27 +275,507 @@ func (h *DNSHandler) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// AddView registers a View to answer queries from clients in its networks.
+// Views are evaluated in the order they are added.
+func (h *DNSHandler) AddView(v *View) {
+	h.views = append(h.views, v)
+}
+
+// viewFor returns the first View containing a client's address, or nil
+func (h *DNSHandler) viewFor(ip net.IP) *View {
+	if ip == nil {
+		return nil
+	}
+
+	for _, v := range h.views {
+		if v.Contains(ip) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// viewNetworks returns the networks of every View
+func (h *DNSHandler) viewNetworks() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, v := range h.views {
+		networks = append(networks, v.networks...)
+	}
+
+	return networks
+}
+
+// clientIP returns the IP address of a client
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.ParseIP(addr.String())
+	}
+
+	return net.ParseIP(host)
+}
+
+// metricService returns the service label of metrics for a service. Metrics
+// for services in a View are labeled <service>@<view>, and in a region
+// <service>@<region>.
+func (h *DNSHandler) metricService(service string) string {
+	switch {
+	case h.view != "":
+		return service + "@" + h.view
+	case h.region != "":
+		return service + "@" + h.region
+	}
+
+	return service
+}
+
+// SetLocator enables regional selection. Records for clients in a region
+// are selected from the healthy addresses in that region, or from every
+// healthy address if none are in the region. Changes to regional records
+// are sent to the given listeners.
+func (h *DNSHandler) SetLocator(l Locator, listeners ...ChangeListener) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.locator = l
+	h.regions = make(map[string]*DNSHandler)
+	h.regionListeners = listeners
+}
+
+// updateRegions updates the record for a service in each known region
+func (h *DNSHandler) updateRegions(ctx context.Context, a *RecordEntry) {
+	h.mu.Lock()
+	if h.locator == nil {
+		h.mu.Unlock()
+		return
+	}
+
+	for _, region := range a.regions {
+		if _, ok := h.regions[region]; region != "" && !ok {
+			rh := NewDNSHandler(h.zone, h.logger.With("region", region))
+			rh.region = region
+			rh.listeners = h.regionListeners
+			h.regions[region] = rh
+		}
+	}
+
+	regions := make(map[string]*DNSHandler, len(h.regions))
+	for region, rh := range h.regions {
+		regions[region] = rh
+	}
+	h.mu.Unlock()
+
+	for region, rh := range regions {
+		local := regionRecords(region, a.addresses, a.regions)
+		if len(local) == 0 {
+			rh.remove(a.service)
+			continue
+		}
+		rh.update(ctx, a.service, local, a.reason, a.ordered)
+	}
+}
+
+// remove stops serving a record for a service, so that queries for it are
+// answered by the handler for all clients
+func (h *DNSHandler) remove(service string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	serviceHealthy.WithLabelValues(h.metricService(service)).Set(0)
+
+	rec := fmt.Sprintf("%s.%s.", service, h.zone)
+	if _, ok := h.svcMap[rec]; !ok {
+		return
+	}
+
+	h.logger.Info("Removing service map record", "service", service)
+	delete(h.svcMap, rec)
+	delete(h.records, service)
+}
+
+// regionHandlerFor returns the handler answering a name for clients in a
+// region, or nil if the name should be answered by h. Regional records are
+// not used for services that are pinned, or follow an HA leader.
+func (h *DNSHandler) regionHandlerFor(region, domain string) *DNSHandler {
+	h.mu.RLock()
+	rh := h.regions[region]
+	state := h.records[strings.TrimSuffix(domain, "."+h.zone+".")]
+	h.mu.RUnlock()
+
+	if rh == nil || state != nil && (state.pinned || state.following) {
+		return nil
+	}
+
+	rh.mu.RLock()
+	_, ok := rh.svcMap[domain]
+	rh.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	return rh
+}
+
+// AddListener registers a ChangeListener to be notified of record changes
+func (h *DNSHandler) AddListener(l ChangeListener) {
+	h.listeners = append(h.listeners, l)
+}
+
 // UpdateRecord updates the record value that hobson will serve for a
 // given service. In order to avoid unnecessary flapping during service
 // health/registration churn, UpdateRecord will only update the record
 // value when the candidate record in a given set of records is not the
-// current record value.
+// current record value. An empty set of records leaves the current record
+// in place, and pinned records are not updated.
 func (h *DNSHandler) UpdateRecord(service string, records []string) {
+	h.update(context.Background(), service, records, "", false)
+}
+
+// update updates the record value for a service, tracing the selection
+// decision as a child of the span in ctx. If reason is set, it is reported
+// in place of the reason for a change to another record. If ordered is
+// set, records are in order of preference, and the first is served. The
+// resulting change, if any, is returned.
+func (h *DNSHandler) update(ctx context.Context, service string, records []string, reason ChangeReason, ordered bool) *RecordChange {
+	_, span := tracer().Start(ctx, spanUpdate, trace.WithAttributes(
+		attribute.String("service", service),
+		attribute.Int("healthy", len(records)),
+	))
+	defer span.End()
+
+	c := h.updateRecord(service, records, reason, ordered)
+	span.SetAttributes(attribute.Bool("changed", c != nil))
+	if c == nil {
+		return nil
+	}
+
+	span.SetAttributes(
+		attribute.String("address.old", c.OldAddress),
+		attribute.String("address.new", c.NewAddress),
+		attribute.String("reason", string(c.Reason)),
+	)
+	h.notify(c)
+
+	return c
+}
+
+// observePropagation records the time taken for a change received from the
+// backend to become visible in the served record
+func observePropagation(service string, a *RecordEntry, visible time.Time) {
+	if !a.changed.IsZero() {
+		propagationDuration.WithLabelValues(service).Observe(visible.Sub(a.changed).Seconds())
+	}
+
+	if !a.checkChanged.IsZero() {
+		checkPropagationDuration.WithLabelValues(service).Observe(visible.Sub(a.checkChanged).Seconds())
+	}
+}
+
+func (h *DNSHandler) updateRecord(service string, records []string, hint ChangeReason, ordered bool) *RecordChange {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	rec := fmt.Sprintf("%s.%s.", service, h.zone)
 	cur := h.svcMap[rec]
 
+	state := h.recordState(service)
+	state.healthy = append([]string(nil), records...)
+	state.ordered = ordered
+	serviceHealthy.WithLabelValues(h.metricService(service)).Set(float64(len(records)))
+
+	if state.pinned || state.following {
+		return nil
+	}
+
+	if len(records) == 0 {
+		if state.empty || cur == nil {
+			return nil
+		}
+		state.empty = true
+		return h.change(service, cur, cur, ReasonEmptyPool)
+	}
+	state.empty = false
+
+	kept := false
 	for _, record := range records {
 		if bytes.Compare(net.ParseIP(record), cur) == 0 {
-			return
+			kept = true
 		}
 	}
 
-	sort.Strings(records)
+	// the current record is kept while it is healthy, unless the records
+	// are ordered and another record is preferred
+	if kept && !ordered {
+		return nil
+	}
+	if !ordered {
+		sort.Strings(records)
+	}
 	newRecord := records[0]
-	log.Printf("Updating service map record %s (%s)", service, newRecord)
+	if bytes.Compare(net.ParseIP(newRecord), cur) == 0 {
+		return nil
+	}
+
+	h.logger.Info("Updating service map record", "service", service, "address", newRecord)
 	h.svcMap[rec] = net.ParseIP(newRecord)
-	recordUpdateTime.WithLabelValues(service).SetToCurrentTime()
+	recordUpdateTime.WithLabelValues(h.metricService(service)).SetToCurrentTime()
+
+	reason := ReasonUnhealthy
+	switch {
+	case cur == nil:
+		reason = ReasonInitial
+	case hint != "":
+		reason = hint
+	case newRecord == state.previous:
+		reason = ReasonFailback
+	case kept:
+		reason = ReasonNearer
+	}
+
+	return h.change(service, cur, h.svcMap[rec], reason)
+}
+
+// Pin sets the record value for a service to a given address, regardless of
+// the health of the service's records, until Unpin is called
+func (h *DNSHandler) Pin(service, address string) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+
+	h.mu.Lock()
+	if _, ok := h.records[service]; !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("unknown service %q", service)
+	}
+
+	rec := fmt.Sprintf("%s.%s.", service, h.zone)
+	cur := h.svcMap[rec]
+
+	h.logger.Info("Pinning service map record", "service", service, "address", address)
+	h.recordState(service).pinned = true
+	h.svcMap[rec] = ip
+	recordUpdateTime.WithLabelValues(h.metricService(service)).SetToCurrentTime()
+
+	c := h.change(service, cur, ip, ReasonManualPin)
+	h.mu.Unlock()
+
+	h.notify(c)
+	return nil
+}
+
+// Unpin removes a pinned record value for a service, and immediately
+// reselects a record from the most recent set of healthy records
+func (h *DNSHandler) Unpin(service string) error {
+	h.mu.Lock()
+	state, ok := h.records[service]
+	if !ok || !state.pinned {
+		h.mu.Unlock()
+		return fmt.Errorf("service %q is not pinned", service)
+	}
+
+	h.logger.Info("Unpinning service map record", "service", service)
+	state.pinned = false
+	healthy := state.healthy
+	h.mu.Unlock()
+
+	h.UpdateRecord(service, healthy)
+	return nil
+}
+
+// Follow sets the record value for a service to the address selected by
+// another instance, until Unfollow is called. A pinned record is not changed.
+func (h *DNSHandler) Follow(service, address string) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+
+	h.mu.Lock()
+	state := h.recordState(service)
+	state.following = true
+
+	rec := fmt.Sprintf("%s.%s.", service, h.zone)
+	cur := h.svcMap[rec]
+	if state.pinned || cur.Equal(ip) {
+		h.mu.Unlock()
+		return nil
+	}
+
+	h.logger.Info("Following service map record", "service", service, "address", address)
+	h.svcMap[rec] = ip
+	recordUpdateTime.WithLabelValues(h.metricService(service)).SetToCurrentTime()
+
+	c := h.change(service, cur, ip, ReasonLeader)
+	h.mu.Unlock()
+
+	h.notify(c)
+	return nil
+}
+
+// Unfollow returns a service to local selection, and immediately reselects
+// a record from the most recent set of healthy records, keeping the
+// followed record if it is healthy. The resulting change, if any, is
+// returned.
+func (h *DNSHandler) Unfollow(service string) *RecordChange {
+	h.mu.Lock()
+	state, ok := h.records[service]
+	if !ok || !state.following {
+		h.mu.Unlock()
+		return nil
+	}
+
+	h.logger.Info("Unfollowing service map record", "service", service)
+	state.following = false
+	healthy, ordered := state.healthy, state.ordered
+	h.mu.Unlock()
+
+	return h.update(context.Background(), service, healthy, "", ordered)
+}
+
+// Fallback returns a service to local selection, and selects the lowest of
+// the most recent set of healthy records, or the first if they are ordered.
+// Unlike Unfollow, the result does
+// not depend on the service's previous records, so instances falling back
+// together select the same record. A pinned record is not changed, and an
+// empty set of records leaves the current record in place. The resulting
+// change, if any, is returned.
+func (h *DNSHandler) Fallback(service string) *RecordChange {
+	h.mu.Lock()
+	state := h.recordState(service)
+	state.following = false
+
+	if state.pinned || len(state.healthy) == 0 {
+		healthy, ordered := state.healthy, state.ordered
+		h.mu.Unlock()
+
+		return h.update(context.Background(), service, healthy, "", ordered)
+	}
+	state.empty = false
+
+	records := append([]string(nil), state.healthy...)
+	if !state.ordered {
+		sort.Strings(records)
+	}
+	ip := net.ParseIP(records[0])
+
+	rec := fmt.Sprintf("%s.%s.", service, h.zone)
+	cur := h.svcMap[rec]
+	if cur.Equal(ip) {
+		h.mu.Unlock()
+		return nil
+	}
+
+	h.logger.Info("Falling back to local selection", "service", service, "address", records[0])
+	h.svcMap[rec] = ip
+	recordUpdateTime.WithLabelValues(h.metricService(service)).SetToCurrentTime()
+
+	reason := ReasonFallback
+	if cur == nil {
+		reason = ReasonInitial
+	}
+	c := h.change(service, cur, ip, reason)
+	h.mu.Unlock()
+
+	h.notify(c)
+	return c
+}
+
+// Selected returns the address currently served for a service, or an empty
+// string if no address is served
+func (h *DNSHandler) Selected(service string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return ipString(h.svcMap[fmt.Sprintf("%s.%s.", service, h.zone)])
+}
+
+// ServePin pins a service's record to an address on POST, and removes the
+// pin on DELETE
+func (h *DNSHandler) ServePin(w http.ResponseWriter, r *http.Request) {
+	service := r.FormValue("service")
+
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = h.Pin(service, r.FormValue("address"))
+	case http.MethodDelete:
+		err = h.Unpin(service)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordState returns the selection state for a service, creating it if
+// necessary. h.mu must be held.
+func (h *DNSHandler) recordState(service string) *recordState {
+	if h.records == nil {
+		h.records = make(map[string]*recordState)
+	}
+
+	state, ok := h.records[service]
+	if !ok {
+		state = &recordState{}
+		h.records[service] = state
+	}
+
+	return state
+}
+
+// change builds a RecordChange and tracks the previous record value of a
+// service. h.mu must be held.
+func (h *DNSHandler) change(service string, old, new net.IP, reason ChangeReason) *RecordChange {
+	state := h.recordState(service)
+	if !old.Equal(new) {
+		state.previous = ipString(old)
+
+		if old != nil {
+			recordSelected.DeleteLabelValues(h.metricService(service), ipString(old))
+		}
+		recordSelected.WithLabelValues(h.metricService(service), ipString(new)).Set(1)
+	}
+	if reason.failover() {
+		failoverTotal.WithLabelValues(h.metricService(service), string(reason)).Inc()
+	}
+
+	return &RecordChange{
+		Time:       time.Now(),
+		Service:    service,
+		OldAddress: ipString(old),
+		NewAddress: ipString(new),
+		Healthy:    state.healthy,
+		Reason:     reason,
+		View:       h.view,
+		Region:     h.region,
+	}
+}
+
+func (h *DNSHandler) notify(c *RecordChange) {
+	for _, l := range h.listeners {
+		l.RecordChanged(c)
+	}
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
 }
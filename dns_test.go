@@ -5,7 +5,9 @@ import (
 	"net"
 	"testing"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type MockAddr struct{}
@@ -151,6 +153,7 @@ func Test_dnsHandler_ServeDNS(t *testing.T) {
 			h := &DNSHandler{
 				zone:       tt.fields.zone,
 				svcMap:     tt.fields.svcMap,
+				logger:     hclog.NewNullLogger(),
 				shutdownCh: tt.fields.shutdownCh,
 			}
 			h.ServeDNS(tt.args.w, tt.args.r)
@@ -310,6 +313,7 @@ func Test_dnsHandler_UpdateRecord(t *testing.T) {
 			h := &DNSHandler{
 				zone:       tt.fields.zone,
 				svcMap:     tt.fields.svcMap,
+				logger:     hclog.NewNullLogger(),
 				shutdownCh: tt.fields.shutdownCh,
 			}
 			h.UpdateRecord(tt.args.service, tt.args.records)
@@ -323,3 +327,263 @@ func Test_dnsHandler_UpdateRecord(t *testing.T) {
 		})
 	}
 }
+
+type MockListener struct {
+	changes []*RecordChange
+}
+
+func (m *MockListener) RecordChanged(c *RecordChange) {
+	m.changes = append(m.changes, c)
+}
+
+func Test_dnsHandler_UpdateRecord_reason(t *testing.T) {
+	tests := []struct {
+		name          string
+		updates       [][]string
+		want          []ChangeReason
+		wantFailovers float64
+	}{
+		{
+			"initial record",
+			[][]string{
+				{"127.0.0.1"},
+			},
+			[]ChangeReason{ReasonInitial},
+			0,
+		},
+		{
+			"current record unhealthy",
+			[][]string{
+				{"127.0.0.1"},
+				{"127.0.0.2"},
+			},
+			[]ChangeReason{ReasonInitial, ReasonUnhealthy},
+			1,
+		},
+		{
+			"failback to previous record",
+			[][]string{
+				{"127.0.0.1"},
+				{"127.0.0.2"},
+				{"127.0.0.1"},
+			},
+			[]ChangeReason{ReasonInitial, ReasonUnhealthy, ReasonFailback},
+			2,
+		},
+		{
+			"empty pool reported once",
+			[][]string{
+				{"127.0.0.1"},
+				{},
+				{},
+				{"127.0.0.1"},
+			},
+			[]ChangeReason{ReasonInitial, ReasonEmptyPool},
+			0,
+		},
+		{
+			"no change for current record",
+			[][]string{
+				{"127.0.0.1"},
+				{"127.0.0.2", "127.0.0.1"},
+			},
+			[]ChangeReason{ReasonInitial},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &MockListener{}
+			h := NewDNSHandler("foo", hclog.NewNullLogger())
+			h.AddListener(l)
+			before := failovers("bar")
+
+			for _, records := range tt.updates {
+				h.UpdateRecord("bar", records)
+			}
+
+			if len(l.changes) != len(tt.want) {
+				t.Fatalf("UpdateRecord() produced %d changes, want %d", len(l.changes), len(tt.want))
+			}
+			for i, c := range l.changes {
+				if c.Reason != tt.want[i] {
+					t.Errorf("UpdateRecord() change %d reason = %v, want %v", i, c.Reason, tt.want[i])
+				}
+			}
+
+			if got := failovers("bar") - before; got != tt.wantFailovers {
+				t.Errorf("UpdateRecord() counted %v failovers, want %v", got, tt.wantFailovers)
+			}
+		})
+	}
+}
+
+// failovers returns the total count of failovers of a service
+func failovers(service string) float64 {
+	var n float64
+	for _, r := range []ChangeReason{ReasonInitial, ReasonUnhealthy, ReasonFailback, ReasonManualPin, ReasonEmptyPool, ReasonNearer, ReasonLeader} {
+		n += testutil.ToFloat64(failoverTotal.WithLabelValues(service, string(r)))
+	}
+
+	return n
+}
+
+func Test_dnsHandler_Pin(t *testing.T) {
+	l := &MockListener{}
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.AddListener(l)
+
+	if err := h.Pin("bar", "127.0.0.9"); err == nil {
+		t.Errorf("Pin() expected error for unknown service")
+	}
+
+	h.UpdateRecord("bar", []string{"127.0.0.1", "127.0.0.2"})
+
+	if err := h.Pin("bar", "127.0.0.9"); err != nil {
+		t.Fatalf("Pin() error = %v", err)
+	}
+	h.UpdateRecord("bar", []string{"127.0.0.2"})
+	if ip := h.svcMap["bar.foo."]; !ip.Equal(net.ParseIP("127.0.0.9")) {
+		t.Errorf("Pin() expected pinned record to be served, saw %v", ip)
+	}
+
+	if err := h.Unpin("bar"); err != nil {
+		t.Fatalf("Unpin() error = %v", err)
+	}
+	if ip := h.svcMap["bar.foo."]; !ip.Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("Unpin() expected healthy record to be served, saw %v", ip)
+	}
+
+	want := []ChangeReason{ReasonInitial, ReasonManualPin, ReasonUnhealthy}
+	if len(l.changes) != len(want) {
+		t.Fatalf("Pin() produced %d changes, want %d", len(l.changes), len(want))
+	}
+	for i, c := range l.changes {
+		if c.Reason != want[i] {
+			t.Errorf("Pin() change %d reason = %v, want %v", i, c.Reason, want[i])
+		}
+	}
+}
+
+func Test_dnsHandler_Follow(t *testing.T) {
+	l := &MockListener{}
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.AddListener(l)
+
+	h.UpdateRecord("bar", []string{"127.0.0.1", "127.0.0.2"})
+
+	if err := h.Follow("bar", "127.0.0.2"); err != nil {
+		t.Fatalf("Follow() error = %v", err)
+	}
+	h.UpdateRecord("bar", []string{"127.0.0.1"})
+	if got := h.Selected("bar"); got != "127.0.0.2" {
+		t.Errorf("Follow() expected followed record to be served, saw %v", got)
+	}
+
+	// following the record already served is not a change
+	if err := h.Follow("bar", "127.0.0.2"); err != nil {
+		t.Fatalf("Follow() error = %v", err)
+	}
+
+	h.Unfollow("bar")
+	if got := h.Selected("bar"); got != "127.0.0.1" {
+		t.Errorf("Unfollow() expected healthy record to be served, saw %v", got)
+	}
+
+	want := []ChangeReason{ReasonInitial, ReasonLeader, ReasonFailback}
+	if len(l.changes) != len(want) {
+		t.Fatalf("Follow() produced %d changes, want %d", len(l.changes), len(want))
+	}
+	for i, c := range l.changes {
+		if c.Reason != want[i] {
+			t.Errorf("Follow() change %d reason = %v, want %v", i, c.Reason, want[i])
+		}
+	}
+}
+
+func Test_dnsHandler_Fallback(t *testing.T) {
+	l := &MockListener{}
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.AddListener(l)
+
+	h.UpdateRecord("bar", []string{"127.0.0.2"})
+	h.UpdateRecord("bar", []string{"127.0.0.1", "127.0.0.2"})
+
+	if err := h.Follow("bar", "127.0.0.3"); err != nil {
+		t.Fatalf("Follow() error = %v", err)
+	}
+
+	// the lowest healthy record is selected, though the record served
+	// before following is healthy
+	if c := h.Fallback("bar"); c == nil || c.Reason != ReasonFallback {
+		t.Errorf("Fallback() change = %v, want reason %v", c, ReasonFallback)
+	}
+	if got := h.Selected("bar"); got != "127.0.0.1" {
+		t.Errorf("Fallback() expected lowest healthy record to be served, saw %v", got)
+	}
+
+	if c := h.Fallback("bar"); c != nil {
+		t.Errorf("Fallback() of the lowest record produced change %v", c)
+	}
+	if got := len(l.changes); got != 3 {
+		t.Errorf("Fallback() produced %d changes, want 3", got)
+	}
+}
+
+func Test_dnsHandler_ServeDNS_queryTotal(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		service string
+		qlabel  string
+		rcode   string
+	}{
+		{
+			"known name",
+			"bar.foo.",
+			dns.TypeA,
+			"bar",
+			"A",
+			"NOERROR",
+		},
+		{
+			"unknown name",
+			"nope.foo.",
+			dns.TypeA,
+			unknownServiceLabel,
+			"A",
+			"NXDOMAIN",
+		},
+		{
+			"uncommon query type",
+			"bar.foo.",
+			dns.TypeNAPTR,
+			"bar",
+			"other",
+			"NOERROR",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewDNSHandler("foo", hclog.NewNullLogger())
+			h.svcMap["bar.foo."] = net.ParseIP("127.0.0.1")
+
+			c := queryTotal.WithLabelValues(tt.service, tt.qlabel, tt.rcode)
+			before := testutil.ToFloat64(c)
+
+			h.ServeDNS(NewMockResponseWriter(), &dns.Msg{
+				Question: []dns.Question{
+					{
+						Qtype: tt.qtype,
+						Name:  tt.qname,
+					},
+				},
+			})
+
+			if got := testutil.ToFloat64(c) - before; got != 1 {
+				t.Errorf("ServeDNS() counted %v queries, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// DnstapHandler wraps a dns.Handler, emitting a dnstap AUTH_QUERY and
+// AUTH_RESPONSE message for every query. Messages are buffered, and are
+// dropped when the buffer is full, so a slow collector never delays queries.
+type DnstapHandler struct {
+	next dns.Handler
+
+	identity []byte
+	output   dnstap.Output
+	queue    chan []byte
+
+	logger hclog.Logger
+
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+// dnstapLogger adapts an hclog.Logger to the dnstap.Logger interface
+type dnstapLogger struct {
+	hclog.Logger
+}
+
+func (l dnstapLogger) Printf(format string, v ...interface{}) {
+	l.Warn(fmt.Sprintf(format, v...))
+}
+
+// NewDnstapOutput creates a dnstap.Output for a given configuration, writing
+// to a Unix socket, TCP endpoint or file
+func NewDnstapOutput(config DnstapConfig, logger hclog.Logger) (dnstap.Output, error) {
+	switch {
+	case config.Unix != "":
+		o, err := dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: config.Unix, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		o.SetLogger(dnstapLogger{logger})
+		return o, nil
+	case config.TCP != "":
+		addr, err := net.ResolveTCPAddr("tcp", config.TCP)
+		if err != nil {
+			return nil, err
+		}
+		o, err := dnstap.NewFrameStreamSockOutput(addr)
+		if err != nil {
+			return nil, err
+		}
+		o.SetLogger(dnstapLogger{logger})
+		return o, nil
+	case config.File != "":
+		o, err := dnstap.NewFrameStreamOutputFromFilename(config.File)
+		if err != nil {
+			return nil, err
+		}
+		o.SetLogger(dnstapLogger{logger})
+		return o, nil
+	}
+
+	return nil, errors.New("no dnstap output defined")
+}
+
+// NewDnstapHandler creates a new DnstapHandler object, wrapping a given
+// dns.Handler and writing messages to a given dnstap.Output
+func NewDnstapHandler(next dns.Handler, output dnstap.Output, identity string, bufferSize int, logger hclog.Logger) *DnstapHandler {
+	return &DnstapHandler{
+		next:       next,
+		identity:   []byte(identity),
+		output:     output,
+		queue:      make(chan []byte, bufferSize),
+		logger:     logger,
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+}
+
+// Run spawns goroutines to write buffered messages to the dnstap.Output
+func (d *DnstapHandler) Run() {
+	go d.output.RunOutputLoop()
+
+	go func() {
+		defer close(d.doneCh)
+
+		out := d.output.GetOutputChannel()
+		for {
+			select {
+			case frame := <-d.queue:
+				out <- frame
+			case <-d.shutdownCh:
+				for {
+					select {
+					case frame := <-d.queue:
+						out <- frame
+					default:
+						d.output.Close()
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// ServeDNS implements dns.Handler
+func (d *DnstapHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	queryTime := time.Now()
+	d.emit(dnstap.Message_AUTH_QUERY, w, r, queryTime, time.Time{})
+
+	tw := &dnstapResponseWriter{ResponseWriter: w}
+	d.next.ServeDNS(tw, r)
+
+	if tw.msg != nil {
+		d.emit(dnstap.Message_AUTH_RESPONSE, w, tw.msg, queryTime, time.Now())
+	}
+}
+
+func (d *DnstapHandler) emit(t dnstap.Message_Type, w dns.ResponseWriter, m *dns.Msg, queryTime, responseTime time.Time) {
+	packed, err := m.Pack()
+	if err != nil {
+		d.logger.Debug("Failed to pack dnstap message", "error", err)
+		return
+	}
+
+	msg := &dnstap.Message{
+		Type:          &t,
+		QueryTimeSec:  proto.Uint64(uint64(queryTime.Unix())),
+		QueryTimeNsec: proto.Uint32(uint32(queryTime.Nanosecond())),
+	}
+	setDnstapAddrs(msg, w.RemoteAddr(), w.LocalAddr())
+
+	if t == dnstap.Message_AUTH_QUERY {
+		msg.QueryMessage = packed
+	} else {
+		msg.ResponseMessage = packed
+		msg.ResponseTimeSec = proto.Uint64(uint64(responseTime.Unix()))
+		msg.ResponseTimeNsec = proto.Uint32(uint32(responseTime.Nanosecond()))
+	}
+
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Identity: d.identity,
+		Version:  []byte("hobson"),
+		Message:  msg,
+	})
+	if err != nil {
+		d.logger.Debug("Failed to marshal dnstap message", "error", err)
+		return
+	}
+
+	select {
+	case d.queue <- frame:
+	default:
+		dnstapDropped.Inc()
+	}
+}
+
+// setDnstapAddrs sets the socket family, protocol, and query and response
+// addresses of a dnstap message from the addresses of a ResponseWriter
+func setDnstapAddrs(msg *dnstap.Message, remote, local net.Addr) {
+	var queryIP, responseIP net.IP
+	var queryPort, responsePort int
+
+	switch a := remote.(type) {
+	case *net.UDPAddr:
+		msg.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+		queryIP, queryPort = a.IP, a.Port
+	case *net.TCPAddr:
+		msg.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+		queryIP, queryPort = a.IP, a.Port
+	default:
+		return
+	}
+
+	switch a := local.(type) {
+	case *net.UDPAddr:
+		responseIP, responsePort = a.IP, a.Port
+	case *net.TCPAddr:
+		responseIP, responsePort = a.IP, a.Port
+	}
+
+	if ip4 := queryIP.To4(); ip4 != nil {
+		msg.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		queryIP = ip4
+		responseIP = responseIP.To4()
+	} else {
+		msg.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+	}
+
+	msg.QueryAddress = queryIP
+	msg.QueryPort = proto.Uint32(uint32(queryPort))
+	if responseIP != nil {
+		msg.ResponseAddress = responseIP
+		msg.ResponsePort = proto.Uint32(uint32(responsePort))
+	}
+}
+
+// Shutdown flushes buffered messages to the dnstap.Output and closes it
+func (d *DnstapHandler) Shutdown(ctx context.Context) error {
+	close(d.shutdownCh)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.doneCh:
+		return nil
+	}
+}
+
+// dnstapResponseWriter captures the response written by a dns.Handler
+type dnstapResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *dnstapResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/proto"
+)
+
+type MockOutput struct {
+	ch     chan []byte
+	frames [][]byte
+	done   chan struct{}
+}
+
+func NewMockOutput() *MockOutput {
+	return &MockOutput{
+		ch:   make(chan []byte),
+		done: make(chan struct{}),
+	}
+}
+
+func (m *MockOutput) GetOutputChannel() chan []byte {
+	return m.ch
+}
+
+func (m *MockOutput) RunOutputLoop() {
+	for f := range m.ch {
+		m.frames = append(m.frames, f)
+	}
+	close(m.done)
+}
+
+func (m *MockOutput) Close() {
+	close(m.ch)
+	<-m.done
+}
+
+func TestDnstapHandler_ServeDNS(t *testing.T) {
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.svcMap["bar.foo."] = net.ParseIP("127.0.0.1")
+
+	o := NewMockOutput()
+	d := NewDnstapHandler(h, o, "test", 16, hclog.NewNullLogger())
+	d.Run()
+
+	d.ServeDNS(NewMockResponseWriter(), &dns.Msg{
+		Question: []dns.Question{
+			{
+				Qtype: dns.TypeA,
+				Name:  "bar.foo.",
+			},
+		},
+	})
+
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	want := []dnstap.Message_Type{dnstap.Message_AUTH_QUERY, dnstap.Message_AUTH_RESPONSE}
+	if len(o.frames) != len(want) {
+		t.Fatalf("ServeDNS() wrote %d frames, want %d", len(o.frames), len(want))
+	}
+
+	var msgs []*dnstap.Message
+	for i, f := range o.frames {
+		var m dnstap.Dnstap
+		if err := proto.Unmarshal(f, &m); err != nil {
+			t.Fatalf("ServeDNS() wrote invalid frame: %v", err)
+		}
+
+		if m.GetMessage().GetType() != want[i] {
+			t.Errorf("ServeDNS() frame %d type = %v, want %v", i, m.GetMessage().GetType(), want[i])
+		}
+		if string(m.GetIdentity()) != "test" {
+			t.Errorf("ServeDNS() frame %d identity = %s, want test", i, m.GetIdentity())
+		}
+		msgs = append(msgs, m.GetMessage())
+	}
+
+	var resp dns.Msg
+	if err := resp.Unpack(msgs[1].GetResponseMessage()); err != nil {
+		t.Fatalf("ServeDNS() wrote invalid response message: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Errorf("ServeDNS() response message has %d answers, want 1", len(resp.Answer))
+	}
+}
+
+func TestDnstapHandler_ServeDNS_dropped(t *testing.T) {
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+
+	// the handler is not run, so the buffer is never drained
+	d := NewDnstapHandler(h, NewMockOutput(), "", 1, hclog.NewNullLogger())
+	before := testutil.ToFloat64(dnstapDropped)
+
+	d.ServeDNS(NewMockResponseWriter(), &dns.Msg{
+		Question: []dns.Question{
+			{
+				Qtype: dns.TypeA,
+				Name:  "bar.foo.",
+			},
+		},
+	})
+
+	if got := testutil.ToFloat64(dnstapDropped) - before; got != 1 {
+		t.Errorf("ServeDNS() dropped %v messages, want 1", got)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP payload size advertised in responses to queries
+// using EDNS
+const ednsUDPSize = dns.DefaultMsgSize
+
+// dnsClient identifies the client of a query. If a query from a trusted
+// network carries an EDNS Client Subnet option with a non-zero source
+// prefix, the client is the subnet's address; otherwise it is the address
+// from which the query was received.
+type dnsClient struct {
+	ip     net.IP
+	subnet *dns.EDNS0_SUBNET
+
+	// scope is the prefix length echoed in the response's Client Subnet
+	// option, beyond which the answer does not depend on the client
+	scope uint8
+}
+
+// SetECSTrustedNetworks sets the networks from which EDNS Client Subnet
+// options are honored. Any sender can claim any subnet, so options from
+// other networks are ignored, and the client is the address from which the
+// query was received.
+func (h *DNSHandler) SetECSTrustedNetworks(networks []string) error {
+	var trusted []*net.IPNet
+	for _, n := range networks {
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return err
+		}
+		trusted = append(trusted, network)
+	}
+
+	h.ecsTrusted = trusted
+	return nil
+}
+
+// queryClient returns the client of a query received from addr, using the
+// query's Client Subnet option only if addr is in a trusted network
+func queryClient(addr net.Addr, r *dns.Msg, trusted []*net.IPNet) *dnsClient {
+	c := &dnsClient{ip: clientIP(addr)}
+
+	opt := r.IsEdns0()
+	if opt == nil || !containsIP(trusted, c.ip) {
+		return c
+	}
+
+	for _, o := range opt.Option {
+		if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+			c.subnet = s
+			if s.SourceNetmask > 0 {
+				c.ip = s.Address
+			}
+			break
+		}
+	}
+
+	return c
+}
+
+// containsIP returns true if an address is in one of a set of networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ecsScope returns the scope of an answer chosen for a client by a set of
+// networks, or zero if the client did not send a subnet. A scope longer than
+// the client's source prefix tells the resolver that its prefix was too short
+// to choose an answer accurately.
+func ecsScope(c *dnsClient, networks []*net.IPNet) uint8 {
+	if !c.hasSubnet() {
+		return 0
+	}
+
+	return uint8(prefixScope(c.ip, networks))
+}
+
+// hasSubnet returns true if the client's address was taken from a subnet
+func (c *dnsClient) hasSubnet() bool {
+	return c.subnet != nil && c.subnet.SourceNetmask > 0 && c.ip != nil
+}
+
+// prefixScope returns the shortest prefix length of an address for which
+// every address with that prefix is contained by, or disjoint from, each of a
+// set of networks, so that an answer chosen by those networks is the same
+// for every address sharing the prefix
+func prefixScope(ip net.IP, networks []*net.IPNet) int {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	scope := 0
+	for _, n := range networks {
+		if len(n.IP) != len(ip) {
+			continue
+		}
+
+		ones, _ := n.Mask.Size()
+		need := ones
+		if !n.Contains(ip) {
+			// the prefix must be long enough to exclude the network
+			if cpl := commonPrefixLen(ip, n.IP); cpl+1 < need {
+				need = cpl + 1
+			}
+		}
+
+		if need > scope {
+			scope = need
+		}
+	}
+
+	return scope
+}
+
+// commonPrefixLen returns the number of leading bits shared by two
+// addresses of the same length
+func commonPrefixLen(a, b net.IP) int {
+	n := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+
+	return n
+}
+
+// setEdns0 adds an OPT record to a response if the query used EDNS,
+// echoing the client's subnet with its scope
+func setEdns0(msg *dns.Msg, r *dns.Msg, c *dnsClient) {
+	if r.IsEdns0() == nil {
+		return
+	}
+	msg.SetEdns0(ednsUDPSize, false)
+
+	if c.subnet == nil {
+		return
+	}
+
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        c.subnet.Family,
+		SourceNetmask: c.subnet.SourceNetmask,
+		SourceScope:   c.scope,
+		Address:       c.subnet.Address,
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+func testSubnet(address string, source uint8) *dns.EDNS0_SUBNET {
+	ip := net.ParseIP(address)
+	family := uint16(1)
+	if ip.To4() == nil {
+		family = 2
+	} else {
+		ip = ip.To4()
+	}
+
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: source,
+		Address:       ip,
+	}
+}
+
+func testQuery(subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	r := &dns.Msg{}
+	r.SetQuestion("bar.foo.", dns.TypeA)
+
+	if subnet != nil {
+		r.SetEdns0(1232, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, subnet)
+	}
+
+	return r
+}
+
+// testTrusted returns the networks trusted to send Client Subnet options
+func testTrusted(t *testing.T) []*net.IPNet {
+	_, network, err := net.ParseCIDR("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []*net.IPNet{network}
+}
+
+func Test_queryClient(t *testing.T) {
+	trusted := &net.UDPAddr{IP: net.ParseIP("10.0.0.53"), Port: 5353}
+	untrusted := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 5353}
+
+	tests := []struct {
+		name       string
+		remote     net.Addr
+		subnet     *dns.EDNS0_SUBNET
+		want       string
+		wantSubnet bool
+	}{
+		{
+			"without subnet",
+			trusted,
+			nil,
+			"10.0.0.53",
+			false,
+		},
+		{
+			"with subnet",
+			trusted,
+			testSubnet("192.0.2.0", 24),
+			"192.0.2.0",
+			true,
+		},
+		{
+			"with zero source prefix",
+			trusted,
+			testSubnet("0.0.0.0", 0),
+			"10.0.0.53",
+			true,
+		},
+		{
+			"with subnet from untrusted network",
+			untrusted,
+			testSubnet("192.0.2.0", 24),
+			"198.51.100.7",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := queryClient(tt.remote, testQuery(tt.subnet), testTrusted(t))
+			if got := c.ip.String(); got != tt.want {
+				t.Errorf("queryClient() ip = %v, want %v", got, tt.want)
+			}
+			if got := c.subnet != nil; got != tt.wantSubnet {
+				t.Errorf("queryClient() subnet = %v, want %v", got, tt.wantSubnet)
+			}
+		})
+	}
+}
+
+func Test_ecsScope(t *testing.T) {
+	var networks []*net.IPNet
+	for _, n := range []string{"192.0.2.0/24", "198.51.100.128/25", "2001:db8::/32"} {
+		_, network, _ := net.ParseCIDR(n)
+		networks = append(networks, network)
+	}
+
+	tests := []struct {
+		name     string
+		subnet   *dns.EDNS0_SUBNET
+		networks []*net.IPNet
+		want     uint8
+	}{
+		{
+			"without subnet",
+			nil,
+			networks,
+			0,
+		},
+		{
+			"without networks",
+			testSubnet("192.0.2.0", 24),
+			nil,
+			0,
+		},
+		{
+			"contained by network",
+			testSubnet("192.0.2.0", 24),
+			networks,
+			24,
+		},
+		{
+			"shorter source than network",
+			testSubnet("192.0.0.0", 16),
+			networks,
+			23,
+		},
+		{
+			"disjoint from networks",
+			testSubnet("10.1.0.0", 24),
+			networks,
+			1,
+		},
+		{
+			"near a network",
+			testSubnet("198.51.100.0", 24),
+			networks,
+			25,
+		},
+		{
+			"ipv6",
+			testSubnet("2001:db8:1::", 56),
+			networks,
+			32,
+		},
+	}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.53"), Port: 5353}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := queryClient(remote, testQuery(tt.subnet), testTrusted(t))
+			if got := ecsScope(c, tt.networks); got != tt.want {
+				t.Errorf("ecsScope() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsHandler_ServeDNS_ecs(t *testing.T) {
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.UpdateRecord("bar", []string{"10.0.0.1"})
+	if err := h.SetECSTrustedNetworks([]string{"10.0.0.0/24"}); err != nil {
+		t.Fatalf("SetECSTrustedNetworks() error = %v", err)
+	}
+
+	dmz, err := NewView(ViewConfig{Name: "dmz", Networks: []string{"192.0.2.0/24"}}, "foo", []string{"bar"}, NewMockFetcher, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewView() error = %v", err)
+	}
+	dmz.handler.UpdateRecord("bar", []string{"203.0.113.1"})
+	h.AddView(dmz)
+
+	tests := []struct {
+		name       string
+		remote     string
+		subnet     *dns.EDNS0_SUBNET
+		want       string
+		wantEdns   bool
+		wantSubnet bool
+		wantScope  uint8
+	}{
+		{
+			"without edns",
+			"10.0.0.53",
+			nil,
+			"10.0.0.1",
+			false,
+			false,
+			0,
+		},
+		{
+			"subnet in view",
+			"10.0.0.53",
+			testSubnet("192.0.2.128", 25),
+			"203.0.113.1",
+			true,
+			true,
+			24,
+		},
+		{
+			"subnet outside view",
+			"10.0.0.53",
+			testSubnet("10.2.0.0", 16),
+			"10.0.0.1",
+			true,
+			true,
+			1,
+		},
+		{
+			"spoofed subnet from untrusted network",
+			"198.51.100.7",
+			testSubnet("192.0.2.128", 25),
+			"10.0.0.1",
+			true,
+			false,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &RemoteResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(tt.remote), Port: 5353}}
+			h.ServeDNS(w, testQuery(tt.subnet))
+
+			m := w.GetM()
+			if len(m.Answer) != 1 {
+				t.Fatalf("ServeDNS() answers = %d, want 1", len(m.Answer))
+			}
+			if got := m.Answer[0].(*dns.A).A.String(); got != tt.want {
+				t.Errorf("ServeDNS() = %v, want %v", got, tt.want)
+			}
+
+			opt := m.IsEdns0()
+			if (opt != nil) != tt.wantEdns {
+				t.Fatalf("ServeDNS() OPT = %v, want %v", opt != nil, tt.wantEdns)
+			}
+			if opt == nil {
+				return
+			}
+
+			if !tt.wantSubnet {
+				if len(opt.Option) != 0 {
+					t.Errorf("ServeDNS() options = %v, want none", opt.Option)
+				}
+				return
+			}
+			if len(opt.Option) != 1 {
+				t.Fatalf("ServeDNS() options = %v, want client subnet", opt.Option)
+			}
+			s := opt.Option[0].(*dns.EDNS0_SUBNET)
+			if s.SourceNetmask != tt.subnet.SourceNetmask || !s.Address.Equal(tt.subnet.Address) {
+				t.Errorf("ServeDNS() subnet = %v, want %v", s, tt.subnet)
+			}
+			if s.SourceScope != tt.wantScope {
+				t.Errorf("ServeDNS() scope = %v, want %v", s.SourceScope, tt.wantScope)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdProgressInterval is how long a watch may go without a response before
+// a progress notification is requested, so that a prefix without changes is
+// known to be watched
+const etcdProgressInterval = time.Minute
+
+// EtcdInstance is the value of a key registering an instance of a service
+// in etcd. An instance with a Weight of zero is not healthy; an instance
+// without a Weight is healthy.
+type EtcdInstance struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Weight  *int   `json:"weight"`
+}
+
+// NewEtcdClient creates an etcd client for a given configuration
+func NewEtcdClient(config EtcdConfig) (*clientv3.Client, error) {
+	return clientv3.New(clientv3.Config{
+		Endpoints:   config.Endpoints,
+		DialTimeout: config.DialTimeout,
+		Username:    config.Username,
+		Password:    config.Password,
+	})
+}
+
+// EtcdFetcher implements Fetcher to retrieve the addresses of the instances
+// of a service registered under an etcd key prefix. Instances are expected to
+// register keys with a lease, so that an instance is removed when its lease
+// expires.
+type EtcdFetcher struct {
+	prefix string
+
+	client    *clientv3.Client
+	watchCh   clientv3.WatchChan
+	cancel    context.CancelFunc
+	instances map[string]string
+	progress  time.Duration
+
+	fetched bool
+	last    []string
+
+	lastSuccess int64
+	delay       uint64
+
+	backoff func(*uint64)
+	reset   func(*uint64)
+
+	logger hclog.Logger
+}
+
+// NewEtcdFetcher creates an EtcdFetcher for the keys under a given prefix
+func NewEtcdFetcher(prefix string, client *clientv3.Client, logger hclog.Logger) (Fetcher, error) {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	backoff, reset := backoffFuncs()
+
+	return &EtcdFetcher{
+		prefix:    prefix,
+		client:    client,
+		instances: make(map[string]string),
+		progress:  etcdProgressInterval,
+		backoff:   backoff,
+		reset:     reset,
+		logger:    logger.With("prefix", prefix),
+	}, nil
+}
+
+// Fetch returns the addresses of the service's healthy instances. The first
+// call returns immediately; subsequent calls block until the addresses change.
+func (e *EtcdFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	for {
+		if err := e.sync(ctx); err != nil {
+			e.logger.Error("Failed to watch etcd prefix", "error", err)
+			fetchError.WithLabelValues(service, backendEtcd).Inc()
+
+			e.stop()
+			e.backoff(&e.delay)
+			continue
+		}
+		e.reset(&e.delay)
+		atomic.StoreInt64(&e.lastSuccess, time.Now().UnixNano())
+
+		addresses := etcdAddresses(e.instances)
+		if !e.fetched || !reflect.DeepEqual(addresses, e.last) {
+			e.fetched = true
+			e.last = addresses
+			return &FetchResult{
+				Addresses: addresses,
+				Changed:   time.Now(),
+			}
+		}
+	}
+}
+
+// sync reads the keys under the prefix and starts a watch if no watch is
+// running, and otherwise applies the next watch response. Progress
+// notifications are responses without events, and are requested if the
+// watch is quiet, so that a healthy watch of an unchanging prefix succeeds.
+func (e *EtcdFetcher) sync(ctx context.Context) error {
+	if e.watchCh == nil {
+		resp, err := e.client.Get(ctx, e.prefix, clientv3.WithPrefix())
+		if err != nil {
+			return err
+		}
+
+		e.instances = make(map[string]string)
+		for _, kv := range resp.Kvs {
+			e.put(kv)
+		}
+
+		wctx, cancel := context.WithCancel(ctx)
+		e.cancel = cancel
+		e.watchCh = e.client.Watch(clientv3.WithRequireLeader(wctx), e.prefix,
+			clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1),
+			clientv3.WithProgressNotify())
+		return nil
+	}
+
+	t := time.NewTimer(e.progress)
+	defer t.Stop()
+
+	for {
+		select {
+		case resp, ok := <-e.watchCh:
+			if !ok {
+				return errors.New("watch closed")
+			}
+			return e.apply(resp)
+		case <-t.C:
+			// the request is sent on the watch's stream, which is
+			// identified by the metadata of its context
+			if err := e.client.RequestProgress(clientv3.WithRequireLeader(ctx)); err != nil {
+				return err
+			}
+			t.Reset(e.progress)
+		}
+	}
+}
+
+// apply applies the events of a watch response
+func (e *EtcdFetcher) apply(resp clientv3.WatchResponse) error {
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	for _, ev := range resp.Events {
+		switch ev.Type {
+		case mvccpb.PUT:
+			e.put(ev.Kv)
+		case mvccpb.DELETE:
+			// deleted by the instance, or by the expiry of its lease
+			delete(e.instances, string(ev.Kv.Key))
+		}
+	}
+
+	return nil
+}
+
+// put records the address of a healthy instance for a key, or removes the
+// key if its instance is invalid or not healthy
+func (e *EtcdFetcher) put(kv *mvccpb.KeyValue) {
+	key := string(kv.Key)
+
+	address, err := parseEtcdInstance(kv.Value)
+	if err != nil {
+		e.logger.Warn("Ignoring invalid instance", "key", key, "error", err)
+	}
+	if address == "" {
+		delete(e.instances, key)
+		return
+	}
+
+	e.instances[key] = address
+}
+
+// parseEtcdInstance returns the address of an instance if it is healthy,
+// or an empty string
+func parseEtcdInstance(value []byte) (string, error) {
+	var i EtcdInstance
+	if err := json.Unmarshal(value, &i); err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(i.Address).To4() == nil {
+		return "", fmt.Errorf("invalid address %q", i.Address)
+	}
+
+	if i.Port < 0 || i.Port > 65535 {
+		return "", fmt.Errorf("invalid port %d", i.Port)
+	}
+
+	if i.Weight != nil && *i.Weight <= 0 {
+		return "", nil
+	}
+
+	return i.Address, nil
+}
+
+func (e *EtcdFetcher) stop() {
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+	e.watchCh = nil
+}
+
+// etcdAddresses returns the sorted, unique addresses of a set of instances
+func etcdAddresses(instances map[string]string) []string {
+	seen := make(map[string]bool)
+	addresses := []string{}
+
+	for _, a := range instances {
+		if !seen[a] {
+			seen[a] = true
+			addresses = append(addresses, a)
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// Status returns the current state of the connection to etcd
+func (e *EtcdFetcher) Status() FetcherStatus {
+	var last time.Time
+	if n := atomic.LoadInt64(&e.lastSuccess); n != 0 {
+		last = time.Unix(0, n)
+	}
+
+	delay := atomic.LoadUint64(&e.delay)
+
+	return FetcherStatus{
+		LastSuccess:       last,
+		ConsecutiveErrors: delay,
+		Backoff:           backoffDuration(delay),
+	}
+}
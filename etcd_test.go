@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func Test_parseEtcdInstance(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{
+			"address",
+			`{"address": "10.0.0.1"}`,
+			"10.0.0.1",
+			false,
+		},
+		{
+			"address and port",
+			`{"address": "10.0.0.1", "port": 8080, "weight": 10}`,
+			"10.0.0.1",
+			false,
+		},
+		{
+			"zero weight",
+			`{"address": "10.0.0.1", "port": 8080, "weight": 0}`,
+			"",
+			false,
+		},
+		{
+			"invalid address",
+			`{"address": "web1"}`,
+			"",
+			true,
+		},
+		{
+			"invalid port",
+			`{"address": "10.0.0.1", "port": 70000}`,
+			"",
+			true,
+		},
+		{
+			"invalid value",
+			`10.0.0.1`,
+			"",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEtcdInstance([]byte(tt.value))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEtcdInstance() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseEtcdInstance() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// NewEmbeddedEtcd starts an etcd server listening on random local ports
+func NewEmbeddedEtcd(t *testing.T) *embed.Etcd {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+
+	client, _ := url.Parse("http://127.0.0.1:0")
+	peer, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*client}
+	cfg.AdvertiseClientUrls = []url.URL{*client}
+	cfg.ListenPeerUrls = []url.URL{*peer}
+	cfg.AdvertisePeerUrls = []url.URL{*peer}
+	cfg.InitialCluster = cfg.Name + "=" + peer.String()
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("StartEtcd() error = %v", err)
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(time.Second * 10):
+		e.Close()
+		t.Fatalf("embedded etcd did not start")
+	}
+
+	return e
+}
+
+func TestEtcdFetcher_Fetch(t *testing.T) {
+	e := NewEmbeddedEtcd(t)
+	defer e.Close()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{e.Clients[0].Addr().String()},
+		DialTimeout: time.Second * 5,
+	})
+	if err != nil {
+		t.Fatalf("clientv3.New() error = %v", err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	lease, err := client.Grant(ctx, 60)
+	if err != nil {
+		t.Fatalf("Grant() error = %v", err)
+	}
+	client.Put(ctx, "/services/web/1", `{"address": "10.0.0.1", "port": 80}`, clientv3.WithLease(lease.ID))
+	client.Put(ctx, "/services/web/2", `{"address": "10.0.0.2", "port": 80}`)
+	client.Put(ctx, "/services/webapp/1", `{"address": "10.0.0.9", "port": 80}`)
+
+	f, _ := NewEtcdFetcher("/services/web", client, hclog.NewNullLogger())
+
+	if got := f.Fetch(ctx, "web").Addresses; !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Fetch() = %v, want initial addresses", got)
+	}
+
+	resultCh := make(chan *FetchResult, 1)
+	go func() {
+		resultCh <- f.Fetch(ctx, "web")
+	}()
+
+	// revoking the lease removes its keys, as though it expired
+	if _, err := client.Revoke(ctx, lease.ID); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+
+	select {
+	case res := <-resultCh:
+		if !reflect.DeepEqual(res.Addresses, []string{"10.0.0.2"}) {
+			t.Errorf("Fetch() = %v, want addresses without expired instance", res.Addresses)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Fetch() did not return after lease expiry")
+	}
+}
+
+func TestEtcdFetcher_Fetch_quiet(t *testing.T) {
+	e := NewEmbeddedEtcd(t)
+	defer e.Close()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{e.Clients[0].Addr().String()},
+		DialTimeout: time.Second * 5,
+	})
+	if err != nil {
+		t.Fatalf("clientv3.New() error = %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client.Put(ctx, "/services/web/1", `{"address": "10.0.0.1", "port": 80}`)
+
+	f, _ := NewEtcdFetcher("/services/web", client, hclog.NewNullLogger())
+	f.(*EtcdFetcher).progress = time.Millisecond * 50
+
+	if got := f.Fetch(ctx, "web").Addresses; !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("Fetch() = %v, want initial addresses", got)
+	}
+	first := f.(*EtcdFetcher).Status().LastSuccess
+
+	// the prefix does not change, so Fetch does not return
+	go f.Fetch(ctx, "web")
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		s := f.(*EtcdFetcher).Status()
+		if s.LastSuccess.After(first) {
+			if s.ConsecutiveErrors != 0 {
+				t.Errorf("Status() errors = %v, want 0", s.ConsecutiveErrors)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Status() last success did not advance for a quiet prefix")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
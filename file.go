@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/yaml.v2"
+)
+
+// ServiceFile is the format of the file read by a FileFetcher. As YAML is a
+// superset of JSON, the file may also be written as JSON.
+type ServiceFile struct {
+	Services map[string][]FileInstance `yaml:"services"`
+}
+
+// FileInstance describes an instance of a service in a ServiceFile. An
+// instance without a Healthy value is healthy.
+type FileInstance struct {
+	Address string `yaml:"address"`
+	Healthy *bool  `yaml:"healthy"`
+}
+
+// FileFetcher implements Fetcher to retrieve a list of addresses for a given
+// service from a file. The file is polled for changes.
+type FileFetcher struct {
+	service  string
+	path     string
+	interval time.Duration
+
+	fetched bool
+	last    []string
+
+	lastSuccess int64
+	errors      uint64
+
+	logger hclog.Logger
+}
+
+// NewFileFetcher creates a FileFetcher for a given service
+func NewFileFetcher(service string, config FileConfig, logger hclog.Logger) (Fetcher, error) {
+	return &FileFetcher{
+		service:  service,
+		path:     config.Path,
+		interval: config.PollInterval,
+		logger:   logger.With("path", config.Path),
+	}, nil
+}
+
+// Fetch returns the healthy addresses of the service. The first call returns
+// immediately; subsequent calls block until the healthy addresses change, or
+// ctx is done.
+func (f *FileFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	for {
+		addresses, err := readServiceFile(f.path, service)
+		if err != nil {
+			f.logger.Error("Failed to read service file", "error", err)
+			atomic.AddUint64(&f.errors, 1)
+			fetchError.WithLabelValues(service, backendFile).Inc()
+		} else {
+			atomic.StoreUint64(&f.errors, 0)
+			atomic.StoreInt64(&f.lastSuccess, time.Now().UnixNano())
+
+			if !f.fetched || !reflect.DeepEqual(addresses, f.last) {
+				f.fetched = true
+				f.last = addresses
+				return &FetchResult{
+					Addresses: addresses,
+					Changed:   time.Now(),
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			// the addresses are unchanged
+			return &FetchResult{Addresses: f.last}
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+// readServiceFile returns the sorted healthy addresses of a service in a
+// ServiceFile
+func readServiceFile(path, service string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sf ServiceFile
+	if err := yaml.UnmarshalStrict(b, &sf); err != nil {
+		return nil, err
+	}
+
+	addresses := []string{}
+	for _, i := range sf.Services[service] {
+		if i.Healthy == nil || *i.Healthy {
+			addresses = append(addresses, i.Address)
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses, nil
+}
+
+// Status returns the current state of reading the file
+func (f *FileFetcher) Status() FetcherStatus {
+	var last time.Time
+	if n := atomic.LoadInt64(&f.lastSuccess); n != 0 {
+		last = time.Unix(0, n)
+	}
+
+	errors := atomic.LoadUint64(&f.errors)
+
+	var backoff time.Duration
+	if errors > 0 {
+		backoff = f.interval
+	}
+
+	return FetcherStatus{
+		LastSuccess:       last,
+		ConsecutiveErrors: errors,
+		Backoff:           backoff,
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func Test_readServiceFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{
+			"yaml",
+			`
+services:
+  web:
+    - address: 10.0.0.2
+    - address: 10.0.0.1
+      healthy: true
+    - address: 10.0.0.3
+      healthy: false
+`,
+			[]string{"10.0.0.1", "10.0.0.2"},
+			false,
+		},
+		{
+			"json",
+			`{"services": {"web": [{"address": "10.0.0.1", "healthy": false}, {"address": "10.0.0.2"}]}}`,
+			[]string{"10.0.0.2"},
+			false,
+		},
+		{
+			"unknown service",
+			`{"services": {"db": [{"address": "10.0.0.1"}]}}`,
+			[]string{},
+			false,
+		},
+		{
+			"unknown field",
+			`{"services": {"web": [{"addr": "10.0.0.1"}]}}`,
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "services.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readServiceFile(path, "web")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readServiceFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readServiceFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileFetcher_Fetch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"services": {"web": [{"address": "10.0.0.1"}, {"address": "10.0.0.2"}]}}`)
+
+	f, _ := NewFileFetcher("web", FileConfig{Path: path, PollInterval: time.Millisecond * 10}, hclog.NewNullLogger())
+
+	if got := f.Fetch(context.Background(), "web").Addresses; !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Fetch() = %v, want initial addresses", got)
+	}
+
+	resultCh := make(chan *FetchResult, 1)
+	go func() {
+		resultCh <- f.Fetch(context.Background(), "web")
+	}()
+
+	// an unchanged file does not return
+	select {
+	case res := <-resultCh:
+		t.Fatalf("Fetch() returned %v for an unchanged file", res.Addresses)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	os.Remove(path)
+	write(`{"services": {"web": [{"address": "10.0.0.1", "healthy": false}, {"address": "10.0.0.2"}]}}`)
+
+	select {
+	case res := <-resultCh:
+		if !reflect.DeepEqual(res.Addresses, []string{"10.0.0.2"}) {
+			t.Errorf("Fetch() = %v, want changed addresses", res.Addresses)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Fetch() did not return for a changed file")
+	}
+	// a cancelled fetch returns the unchanged addresses
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		resultCh <- f.Fetch(ctx, "web")
+	}()
+	cancel()
+
+	select {
+	case res := <-resultCh:
+		if !reflect.DeepEqual(res.Addresses, []string{"10.0.0.2"}) {
+			t.Errorf("Fetch() = %v after cancellation, want unchanged addresses", res.Addresses)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Fetch() did not return after cancellation")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+	"gopkg.in/yaml.v2"
+)
+
+// Locator maps client addresses to regions
+type Locator interface {
+	// Locate returns the region of an address, or an empty string if the
+	// region is unknown, and the prefix length of the address within which
+	// the region is the same
+	Locate(ip net.IP) (region string, bits int)
+}
+
+// NewLocator creates a Locator for a given configuration
+func NewLocator(config GeoConfig) (Locator, error) {
+	if config.File != "" {
+		return NewCIDRLocator(config.File)
+	}
+
+	return NewMaxMindLocator(config.MaxMindDB, config.MaxMindPath)
+}
+
+// cidrRegion is a network in a region
+type cidrRegion struct {
+	network *net.IPNet
+	region  string
+}
+
+// CIDRLocator implements Locator using a list of networks in each region.
+// An address in several networks is in the region of the most specific.
+type CIDRLocator struct {
+	entries  []cidrRegion
+	networks []*net.IPNet
+}
+
+// NewCIDRLocator creates a CIDRLocator from a YAML file mapping each region
+// to a list of networks in CIDR notation
+func NewCIDRLocator(path string) (*CIDRLocator, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var regions map[string][]string
+	if err := yaml.UnmarshalStrict(b, &regions); err != nil {
+		return nil, err
+	}
+
+	return newCIDRLocator(regions)
+}
+
+func newCIDRLocator(regions map[string][]string) (*CIDRLocator, error) {
+	l := &CIDRLocator{}
+	for region, networks := range regions {
+		for _, n := range networks {
+			_, network, err := net.ParseCIDR(n)
+			if err != nil {
+				return nil, fmt.Errorf("region %q: %v", region, err)
+			}
+
+			l.entries = append(l.entries, cidrRegion{network: network, region: region})
+			l.networks = append(l.networks, network)
+		}
+	}
+
+	return l, nil
+}
+
+// Locate returns the region of the most specific network containing an
+// address
+func (l *CIDRLocator) Locate(ip net.IP) (string, int) {
+	region := ""
+	best := -1
+	for _, e := range l.entries {
+		if ones, _ := e.network.Mask.Size(); e.network.Contains(ip) && ones > best {
+			region = e.region
+			best = ones
+		}
+	}
+
+	return region, prefixScope(ip, l.networks)
+}
+
+// MaxMindLocator implements Locator using a MaxMind-format database. The
+// region of an address is the value of a JSONPath expression in its record,
+// such as $.country.iso_code.
+type MaxMindLocator struct {
+	reader *maxminddb.Reader
+	path   jsonPath
+}
+
+// NewMaxMindLocator creates a MaxMindLocator reading a database at a given
+// path, and the region of each record at a given JSONPath
+func NewMaxMindLocator(db, path string) (*MaxMindLocator, error) {
+	p, err := compileJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := maxminddb.Open(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MaxMindLocator{reader: reader, path: p}, nil
+}
+
+// Locate returns the region of the record for an address
+func (l *MaxMindLocator) Locate(ip net.IP) (string, int) {
+	var record interface{}
+	network, ok, err := l.reader.LookupNetwork(ip, &record)
+
+	bits := 0
+	if network != nil {
+		bits, _ = network.Mask.Size()
+	}
+	if err != nil || !ok {
+		return "", bits
+	}
+
+	return recordRegion(l.path, record), bits
+}
+
+// recordRegion returns the first string matched by a jsonPath in a database
+// record, or an empty string
+func recordRegion(path jsonPath, record interface{}) string {
+	for _, v := range path.eval(record) {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+
+	return ""
+}
+
+// regionRecords returns the addresses in a region
+func regionRecords(region string, records []string, regions map[string]string) []string {
+	var local []string
+	for _, r := range records {
+		if regions[r] == region {
+			local = append(local, r)
+		}
+	}
+
+	return local
+}
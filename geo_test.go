@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+func TestCIDRLocator_Locate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hobson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "regions.yaml")
+	regions := `
+us-east:
+  - 10.1.0.0/16
+eu-west:
+  - 10.2.0.0/16
+  - 10.1.128.0/24
+`
+	if err := ioutil.WriteFile(path, []byte(regions), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewCIDRLocator(path)
+	if err != nil {
+		t.Fatalf("NewCIDRLocator() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		ip         string
+		wantRegion string
+		wantBits   int
+	}{
+		{
+			"in region",
+			"10.2.3.4",
+			"eu-west",
+			16,
+		},
+		{
+			"most specific network",
+			"10.1.128.1",
+			"eu-west",
+			24,
+		},
+		{
+			"outside more specific network",
+			"10.1.0.1",
+			"us-east",
+			17,
+		},
+		{
+			"unknown region",
+			"192.0.2.1",
+			"",
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			region, bits := l.Locate(net.ParseIP(tt.ip))
+			if region != tt.wantRegion || bits != tt.wantBits {
+				t.Errorf("Locate() = %v, %v, want %v, %v", region, bits, tt.wantRegion, tt.wantBits)
+			}
+		})
+	}
+
+	if _, err := newCIDRLocator(map[string][]string{"us-east": {"10.1.0.0"}}); err == nil {
+		t.Error("newCIDRLocator() expected error for invalid network")
+	}
+}
+
+func Test_recordRegion(t *testing.T) {
+	record := map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "DE"},
+		"subdivisions": []interface{}{
+			map[string]interface{}{"iso_code": "BE"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			"country",
+			"$.country.iso_code",
+			"DE",
+		},
+		{
+			"subdivision",
+			"$.subdivisions[0].iso_code",
+			"BE",
+		},
+		{
+			"missing",
+			"$.continent.code",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := compileJSONPath(tt.path)
+			if err != nil {
+				t.Fatalf("compileJSONPath() error = %v", err)
+			}
+
+			if got := recordRegion(p, record); got != tt.want {
+				t.Errorf("recordRegion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_regionRecords(t *testing.T) {
+	records := []string{"10.1.0.1", "10.1.0.2", "10.2.0.1"}
+	regions := map[string]string{"10.1.0.1": "us-east", "10.1.0.2": "us-east", "10.2.0.1": "eu-west"}
+
+	tests := []struct {
+		name   string
+		region string
+		want   []string
+	}{
+		{
+			"instances in region",
+			"us-east",
+			[]string{"10.1.0.1", "10.1.0.2"},
+		},
+		{
+			"no instances in region",
+			"ap-south",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := regionRecords(tt.region, records, regions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("regionRecords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsHandler_ServeDNS_region(t *testing.T) {
+	l, err := newCIDRLocator(map[string][]string{
+		"us-east": {"192.0.2.0/24"},
+		"eu-west": {"198.51.100.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("newCIDRLocator() error = %v", err)
+	}
+
+	listener := &MockListener{}
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.SetLocator(l, listener)
+
+	update := func(addresses []string, regions map[string]string) {
+		a := &RecordEntry{service: "bar", addresses: addresses, regions: regions}
+		h.update(context.Background(), a.service, a.addresses, "", false)
+		h.updateRegions(context.Background(), a)
+	}
+	query := func(client string) string {
+		w := &RemoteResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+		r := &dns.Msg{}
+		r.SetQuestion("bar.foo.", dns.TypeA)
+		h.ServeDNS(w, r)
+
+		return w.GetM().Answer[0].(*dns.A).A.String()
+	}
+
+	update([]string{"10.1.0.1", "10.2.0.1"}, map[string]string{"10.1.0.1": "us-east", "10.2.0.1": "eu-west"})
+	if got := query("198.51.100.1"); got != "10.2.0.1" {
+		t.Errorf("ServeDNS() in region = %v, want 10.2.0.1", got)
+	}
+	if got := query("203.0.113.1"); got != "10.1.0.1" {
+		t.Errorf("ServeDNS() outside regions = %v, want 10.1.0.1", got)
+	}
+
+	// the region has no healthy instances, so is answered with the record
+	// served to other clients
+	h.update(context.Background(), "bar", []string{"10.1.0.2"}, "", false)
+	update([]string{"10.1.0.1", "10.1.0.2"}, map[string]string{"10.1.0.1": "us-east", "10.1.0.2": "us-east"})
+	if got := query("198.51.100.1"); got != "10.1.0.2" {
+		t.Errorf("ServeDNS() after regional failure = %v, want 10.1.0.2", got)
+	}
+
+	update([]string{"10.1.0.2", "10.2.0.1"}, map[string]string{"10.1.0.2": "us-east", "10.2.0.1": "eu-west"})
+	if got := query("198.51.100.1"); got != "10.2.0.1" {
+		t.Errorf("ServeDNS() after regional recovery = %v, want 10.2.0.1", got)
+	}
+
+	if err := h.Pin("bar", "10.9.0.1"); err != nil {
+		t.Fatalf("Pin() error = %v", err)
+	}
+	if got := query("198.51.100.1"); got != "10.9.0.1" {
+		t.Errorf("ServeDNS() when pinned = %v, want 10.9.0.1", got)
+	}
+
+	for _, c := range listener.changes {
+		if c.Region == "" {
+			t.Errorf("regional change %v has no region", c)
+		}
+	}
+}
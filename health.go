@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Health reports the liveness of hobson and the connectivity of the
+// backends used to monitor each service
+type Health struct {
+	config   HealthConfig
+	monitors []*Monitor
+
+	start    time.Time
+	dnsBound int32
+}
+
+// BackendHealth describes the connectivity of a single service's backend
+type BackendHealth struct {
+	Healthy           bool      `json:"healthy"`
+	LastSuccess       time.Time `json:"last_success"`
+	ConsecutiveErrors uint64    `json:"consecutive_errors"`
+	BackoffSeconds    float64   `json:"backoff_seconds"`
+}
+
+// NewHealth creates a new Health object, which reports on the backends of
+// a given Monitor
+func NewHealth(config HealthConfig, m *Monitor) *Health {
+	return &Health{
+		config:   config,
+		monitors: []*Monitor{m},
+		start:    time.Now(),
+	}
+}
+
+// AddMonitor reports on the backends of another Monitor, such as that of a
+// View. It must be called before the Health is served.
+func (h *Health) AddMonitor(m *Monitor) {
+	h.monitors = append(h.monitors, m)
+}
+
+// SetDNSBound marks the DNS listener as bound. It is suitable for use
+// as dns.Server.NotifyStartedFunc.
+func (h *Health) SetDNSBound() {
+	atomic.StoreInt32(&h.dnsBound, 1)
+}
+
+// Alive returns true if the DNS listener has been bound
+func (h *Health) Alive() bool {
+	return atomic.LoadInt32(&h.dnsBound) == 1
+}
+
+// Backends returns the health of each monitored service's backend
+func (h *Health) Backends() map[string]*BackendHealth {
+	now := time.Now()
+	backends := make(map[string]*BackendHealth)
+
+	for _, m := range h.monitors {
+		for service, s := range m.Status() {
+			backends[service] = &BackendHealth{
+				Healthy:           h.config.healthy(s, h.start, now),
+				LastSuccess:       s.LastSuccess,
+				ConsecutiveErrors: s.ConsecutiveErrors,
+				BackoffSeconds:    s.Backoff.Seconds(),
+			}
+		}
+	}
+
+	return backends
+}
+
+// healthy determines if a backend is healthy given the configured thresholds.
+// Backends that have never successfully fetched are measured from the time
+// hobson started.
+func (c HealthConfig) healthy(s FetcherStatus, start, now time.Time) bool {
+	if c.MaxConsecutiveErrors != 0 && s.ConsecutiveErrors >= c.MaxConsecutiveErrors {
+		return false
+	}
+
+	last := s.LastSuccess
+	if last.IsZero() {
+		last = start
+	}
+
+	if c.MaxFetchAge != 0 && now.Sub(last) > c.MaxFetchAge {
+		return false
+	}
+
+	return true
+}
+
+// ServeLiveness responds with a 200 status once the DNS listener is bound
+func (h *Health) ServeLiveness(w http.ResponseWriter, r *http.Request) {
+	if !h.Alive() {
+		http.Error(w, "DNS listener not bound", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+// ServeBackends responds with the health of each service backend, returning
+// a 503 status if any backend is unhealthy
+func (h *Health) ServeBackends(w http.ResponseWriter, r *http.Request) {
+	backends := h.Backends()
+
+	status := http.StatusOK
+	for _, b := range backends {
+		if !b.Healthy {
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(backends)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestHealthConfig_healthy(t *testing.T) {
+	now := time.Now()
+	start := now.Add(-time.Hour)
+
+	type fields struct {
+		MaxConsecutiveErrors uint64
+		MaxFetchAge          time.Duration
+	}
+	type args struct {
+		s FetcherStatus
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   bool
+	}{
+		{
+			"recent fetch with no errors",
+			fields{
+				MaxConsecutiveErrors: 5,
+				MaxFetchAge:          time.Minute * 10,
+			},
+			args{
+				FetcherStatus{
+					LastSuccess: now.Add(-time.Minute),
+				},
+			},
+			true,
+		},
+		{
+			"too many consecutive errors",
+			fields{
+				MaxConsecutiveErrors: 5,
+				MaxFetchAge:          time.Minute * 10,
+			},
+			args{
+				FetcherStatus{
+					LastSuccess:       now.Add(-time.Minute),
+					ConsecutiveErrors: 5,
+				},
+			},
+			false,
+		},
+		{
+			"stale fetch",
+			fields{
+				MaxConsecutiveErrors: 5,
+				MaxFetchAge:          time.Minute * 10,
+			},
+			args{
+				FetcherStatus{
+					LastSuccess: now.Add(-time.Minute * 11),
+				},
+			},
+			false,
+		},
+		{
+			"never fetched, measured from start",
+			fields{
+				MaxConsecutiveErrors: 5,
+				MaxFetchAge:          time.Minute * 10,
+			},
+			args{
+				FetcherStatus{},
+			},
+			false,
+		},
+		{
+			"thresholds disabled",
+			fields{},
+			args{
+				FetcherStatus{
+					LastSuccess:       now.Add(-time.Hour * 24),
+					ConsecutiveErrors: 100,
+				},
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := HealthConfig{
+				MaxConsecutiveErrors: tt.fields.MaxConsecutiveErrors,
+				MaxFetchAge:          tt.fields.MaxFetchAge,
+			}
+			if got := c.healthy(tt.args.s, start, now); got != tt.want {
+				t.Errorf("HealthConfig.healthy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealth_Backends_views(t *testing.T) {
+	last := time.Now()
+
+	m, err := NewMonitor([]string{"bar"}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewMonitor() error = %v", err)
+	}
+	m.fetchers["bar"] = &ChanFetcher{status: FetcherStatus{LastSuccess: last}}
+
+	v, err := NewView(ViewConfig{Name: "dmz", Networks: []string{"192.0.2.0/24"}}, "foo", []string{"bar"}, NewMockFetcher, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewView() error = %v", err)
+	}
+	v.monitor.fetchers["bar"] = &ChanFetcher{status: FetcherStatus{ConsecutiveErrors: 10}}
+
+	h := NewHealth(HealthConfig{MaxConsecutiveErrors: 5}, m)
+	h.AddMonitor(v.monitor)
+
+	backends := h.Backends()
+	if b, ok := backends["bar"]; !ok || !b.Healthy || !b.LastSuccess.Equal(last) {
+		t.Errorf("Backends()[bar] = %+v, want healthy", b)
+	}
+	if b, ok := backends["bar@dmz"]; !ok || b.Healthy || b.ConsecutiveErrors != 10 {
+		t.Errorf("Backends()[bar@dmz] = %+v, want unhealthy view backend", b)
+	}
+}
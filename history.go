@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// History records every change to the records served by a DNSHandler in an
+// in-memory ring buffer, and optionally appends them to a JSON lines file
+type History struct {
+	mu sync.RWMutex
+
+	changes []*RecordChange
+	next    int
+	full    bool
+
+	file *os.File
+	enc  *json.Encoder
+
+	logger hclog.Logger
+}
+
+// NewHistory creates a new History object retaining a given number of
+// changes. If path is not empty, changes are also appended to the file at path.
+func NewHistory(size int, path string, logger hclog.Logger) (*History, error) {
+	h := &History{
+		changes: make([]*RecordChange, size),
+		logger:  logger,
+	}
+
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		h.file = f
+		h.enc = json.NewEncoder(f)
+	}
+
+	return h, nil
+}
+
+// RecordChanged implements ChangeListener
+func (h *History) RecordChanged(c *RecordChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.changes) > 0 {
+		h.changes[h.next] = c
+		h.next = (h.next + 1) % len(h.changes)
+		if h.next == 0 {
+			h.full = true
+		}
+	}
+
+	if h.enc != nil {
+		if err := h.enc.Encode(c); err != nil {
+			h.logger.Error("Error writing history file", "error", err)
+		}
+	}
+}
+
+// Query returns the retained changes, oldest first, for a given service
+// between since and until. An empty service matches all services, and
+// a zero since or until leaves that end of the time range open.
+func (h *History) Query(service string, since, until time.Time) []*RecordChange {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var ordered []*RecordChange
+	if h.full {
+		ordered = append(ordered, h.changes[h.next:]...)
+	}
+	ordered = append(ordered, h.changes[:h.next]...)
+
+	changes := []*RecordChange{}
+	for _, c := range ordered {
+		if service != "" && c.Service != service {
+			continue
+		}
+		if !since.IsZero() && c.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && c.Time.After(until) {
+			continue
+		}
+		changes = append(changes, c)
+	}
+
+	return changes
+}
+
+// ServeHTTP responds with the retained changes as JSON, filtered by the
+// service, since and until query parameters. Times are given in RFC 3339 format.
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var since, until time.Time
+	var err error
+
+	q := r.URL.Query()
+	if s := q.Get("since"); s != "" {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid 'since': "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid 'until': "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Query(q.Get("service"), since, until))
+}
+
+// Shutdown closes the history file, if one is in use
+func (h *History) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+
+	h.enc = nil
+	return h.file.Close()
+}
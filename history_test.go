@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestHistory_Query(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type args struct {
+		service string
+		since   time.Time
+		until   time.Time
+	}
+	tests := []struct {
+		name    string
+		size    int
+		changes []*RecordChange
+		args    args
+		want    []string
+	}{
+		{
+			"all changes",
+			3,
+			[]*RecordChange{
+				{Time: base, Service: "foo", NewAddress: "127.0.0.1"},
+				{Time: base.Add(time.Minute), Service: "bar", NewAddress: "127.0.0.2"},
+			},
+			args{},
+			[]string{"127.0.0.1", "127.0.0.2"},
+		},
+		{
+			"ring buffer wraps oldest first",
+			2,
+			[]*RecordChange{
+				{Time: base, Service: "foo", NewAddress: "127.0.0.1"},
+				{Time: base.Add(time.Minute), Service: "foo", NewAddress: "127.0.0.2"},
+				{Time: base.Add(time.Minute * 2), Service: "foo", NewAddress: "127.0.0.3"},
+			},
+			args{},
+			[]string{"127.0.0.2", "127.0.0.3"},
+		},
+		{
+			"filter by service",
+			3,
+			[]*RecordChange{
+				{Time: base, Service: "foo", NewAddress: "127.0.0.1"},
+				{Time: base.Add(time.Minute), Service: "bar", NewAddress: "127.0.0.2"},
+			},
+			args{
+				service: "bar",
+			},
+			[]string{"127.0.0.2"},
+		},
+		{
+			"filter by time range",
+			3,
+			[]*RecordChange{
+				{Time: base, Service: "foo", NewAddress: "127.0.0.1"},
+				{Time: base.Add(time.Minute), Service: "foo", NewAddress: "127.0.0.2"},
+				{Time: base.Add(time.Minute * 2), Service: "foo", NewAddress: "127.0.0.3"},
+			},
+			args{
+				since: base.Add(time.Second),
+				until: base.Add(time.Minute),
+			},
+			[]string{"127.0.0.2"},
+		},
+		{
+			"zero size retains nothing",
+			0,
+			[]*RecordChange{
+				{Time: base, Service: "foo", NewAddress: "127.0.0.1"},
+			},
+			args{},
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHistory(tt.size, "", hclog.NewNullLogger())
+			if err != nil {
+				t.Fatalf("NewHistory() error = %v", err)
+			}
+
+			for _, c := range tt.changes {
+				h.RecordChanged(c)
+			}
+
+			got := h.Query(tt.args.service, tt.args.since, tt.args.until)
+			if len(got) != len(tt.want) {
+				t.Fatalf("History.Query() returned %d changes, want %d", len(got), len(tt.want))
+			}
+			for i, c := range got {
+				if c.NewAddress != tt.want[i] {
+					t.Errorf("History.Query()[%d] = %v, want %v", i, c.NewAddress, tt.want[i])
+				}
+			}
+		})
+	}
+}
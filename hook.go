@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const hookQueueSize = 16
+const hookOutputMax = 4096
+
+// hookKillDelay is the time given to a command to exit after being
+// interrupted by its timeout, before it is killed
+const hookKillDelay = time.Second
+
+// ExecHook runs a command when the record for a service changes. Runs are
+// serialized, and receive the details of the change as environment variables.
+type ExecHook struct {
+	service string
+	command []string
+	timeout time.Duration
+
+	queue chan *RecordChange
+
+	logger hclog.Logger
+
+	shutdownCh chan struct{}
+}
+
+// NewExecHook creates a new ExecHook object for a given service
+func NewExecHook(service string, command []string, timeout time.Duration, logger hclog.Logger) *ExecHook {
+	return &ExecHook{
+		service:    service,
+		command:    command,
+		timeout:    timeout,
+		queue:      make(chan *RecordChange, hookQueueSize),
+		logger:     logger,
+		shutdownCh: make(chan struct{}),
+	}
+}
+
+// RecordChanged implements ChangeListener. Changes that leave the served
+// address in place do not run the hook.
+func (e *ExecHook) RecordChanged(c *RecordChange) {
+	if c.Service != e.service || c.OldAddress == c.NewAddress {
+		return
+	}
+
+	select {
+	case e.queue <- c:
+	default:
+		e.logger.Warn("Hook queue is full, dropping change", "service", e.service, "address", c.NewAddress)
+		hookRun.WithLabelValues(e.service, "dropped").Inc()
+	}
+}
+
+// Run spawns a goroutine to run the hook for queued changes
+func (e *ExecHook) Run() {
+	go func() {
+		for {
+			select {
+			case <-e.shutdownCh:
+				return
+			case c := <-e.queue:
+				e.exec(c)
+			}
+		}
+	}()
+}
+
+func (e *ExecHook) exec(c *RecordChange) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	// output is written to a file rather than a pipe, so that the command's
+	// exit is not delayed by any children holding its output open
+	out, err := ioutil.TempFile("", "hobson-hook")
+	if err != nil {
+		e.logger.Error("Failed to create hook output file", "service", e.service, "error", err)
+		hookRun.WithLabelValues(e.service, "failure").Inc()
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	cmd := exec.Command(e.command[0], e.command[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = append(os.Environ(),
+		"HOBSON_SERVICE="+c.Service,
+		"HOBSON_OLD_ADDRESS="+c.OldAddress,
+		"HOBSON_NEW_ADDRESS="+c.NewAddress,
+		"HOBSON_REASON="+string(c.Reason),
+	)
+
+	timer := prometheus.NewTimer(hookDuration.WithLabelValues(e.service))
+	err = cmd.Start()
+	if err == nil {
+		doneCh := make(chan struct{})
+		go e.interrupt(ctx, cmd, doneCh)
+		err = cmd.Wait()
+		close(doneCh)
+	}
+	timer.ObserveDuration()
+
+	output, _ := ioutil.ReadAll(io.NewSectionReader(out, 0, hookOutputMax))
+
+	result := "success"
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result = "timeout"
+	case err != nil:
+		result = "failure"
+	}
+	hookRun.WithLabelValues(e.service, result).Inc()
+
+	if err != nil {
+		e.logger.Error("Hook failed",
+			"service", e.service,
+			"address", c.NewAddress,
+			"result", result,
+			"output", string(output),
+			"error", err,
+		)
+		return
+	}
+
+	e.logger.Info("Hook succeeded",
+		"service", e.service,
+		"address", c.NewAddress,
+		"output", string(output),
+	)
+}
+
+// interrupt interrupts a running command when ctx is done, and kills it if
+// it has not exited after hookKillDelay. It returns when doneCh is closed.
+func (e *ExecHook) interrupt(ctx context.Context, cmd *exec.Cmd, doneCh <-chan struct{}) {
+	select {
+	case <-doneCh:
+		return
+	case <-ctx.Done():
+	}
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		// interrupts are not supported on every platform
+		cmd.Process.Kill()
+		return
+	}
+
+	t := time.NewTimer(hookKillDelay)
+	defer t.Stop()
+
+	select {
+	case <-doneCh:
+	case <-t.C:
+		cmd.Process.Kill()
+	}
+}
+
+// Shutdown ends hook activity. Queued changes are discarded, and a
+// running command is allowed to finish.
+func (e *ExecHook) Shutdown(ctx context.Context) error {
+	close(e.shutdownCh)
+	return nil
+}
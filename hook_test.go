@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExecHook_exec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hobson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+
+	tests := []struct {
+		name       string
+		command    []string
+		timeout    time.Duration
+		wantResult string
+		wantOutput string
+	}{
+		{
+			"environment is passed",
+			[]string{"/bin/sh", "-c", "echo $HOBSON_SERVICE $HOBSON_OLD_ADDRESS $HOBSON_NEW_ADDRESS $HOBSON_REASON > " + out},
+			time.Second,
+			"success",
+			"bar 127.0.0.1 127.0.0.2 current_unhealthy",
+		},
+		{
+			"non-zero exit",
+			[]string{"/bin/sh", "-c", "exit 1"},
+			time.Second,
+			"failure",
+			"",
+		},
+		{
+			"timeout",
+			[]string{"/bin/sh", "-c", "sleep 5"},
+			time.Millisecond * 100,
+			"timeout",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewExecHook("bar", tt.command, tt.timeout, hclog.NewNullLogger())
+			before := testutil.ToFloat64(hookRun.WithLabelValues("bar", tt.wantResult))
+
+			e.exec(&RecordChange{
+				Service:    "bar",
+				OldAddress: "127.0.0.1",
+				NewAddress: "127.0.0.2",
+				Reason:     ReasonUnhealthy,
+			})
+
+			if got := testutil.ToFloat64(hookRun.WithLabelValues("bar", tt.wantResult)) - before; got != 1 {
+				t.Errorf("ExecHook.exec() recorded %v %q results, want 1", got, tt.wantResult)
+			}
+
+			if tt.wantOutput != "" {
+				b, err := ioutil.ReadFile(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := strings.TrimSpace(string(b)); got != tt.wantOutput {
+					t.Errorf("ExecHook.exec() wrote %q, want %q", got, tt.wantOutput)
+				}
+			}
+		})
+	}
+}
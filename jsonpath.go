@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is a single step of a jsonPath: a member name, an array
+// index, or a wildcard matching every member or element
+type jsonPathStep struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// jsonPath is a compiled JSONPath expression. Only a subset of JSONPath is
+// supported: the root $, dot and bracketed member names, array indexes, and
+// wildcards, e.g. $.services[*].address or $['hosts'][0].
+type jsonPath []jsonPathStep
+
+// compileJSONPath parses a JSONPath expression
+func compileJSONPath(expr string) (jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("JSONPath %q must begin with $", expr)
+	}
+
+	var p jsonPath
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if name == "" {
+				return nil, fmt.Errorf("JSONPath %q has an empty member name", expr)
+			}
+			p = append(p, jsonPathStep{name: name, wildcard: name == "*"})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("JSONPath %q has an unterminated [", expr)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+
+			switch {
+			case inner == "*":
+				p = append(p, jsonPathStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				p = append(p, jsonPathStep{name: inner[1 : len(inner)-1]})
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("JSONPath %q has an invalid index %q", expr, inner)
+				}
+				p = append(p, jsonPathStep{index: i, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("JSONPath %q has an unexpected %q", expr, rest[0])
+		}
+	}
+
+	return p, nil
+}
+
+// eval returns the values matched by a jsonPath in a value decoded by
+// encoding/json. Steps that do not match a value are ignored.
+func (p jsonPath) eval(v interface{}) []interface{} {
+	values := []interface{}{v}
+
+	for _, step := range p {
+		var next []interface{}
+		for _, v := range values {
+			switch t := v.(type) {
+			case map[string]interface{}:
+				if step.wildcard {
+					for _, m := range t {
+						next = append(next, m)
+					}
+				} else if m, ok := t[step.name]; ok && !step.isIndex {
+					next = append(next, m)
+				}
+			case []interface{}:
+				if step.wildcard {
+					next = append(next, t...)
+				} else if step.isIndex && step.index < len(t) {
+					next = append(next, t[step.index])
+				}
+			}
+		}
+		values = next
+	}
+
+	return values
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func Test_jsonPath_eval(t *testing.T) {
+	body := `{
+		"hosts": [
+			{"address": "10.0.0.1", "tags": ["a"]},
+			{"address": "10.0.0.2", "tags": ["b"]}
+		],
+		"primary": {"address": "10.0.0.3"}
+	}`
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		expr    string
+		want    []interface{}
+		wantErr bool
+	}{
+		{
+			"member names",
+			"$.primary.address",
+			[]interface{}{"10.0.0.3"},
+			false,
+		},
+		{
+			"array wildcard",
+			"$.hosts[*].address",
+			[]interface{}{"10.0.0.1", "10.0.0.2"},
+			false,
+		},
+		{
+			"array index",
+			"$.hosts[1].address",
+			[]interface{}{"10.0.0.2"},
+			false,
+		},
+		{
+			"bracketed member name",
+			"$['primary'][\"address\"]",
+			[]interface{}{"10.0.0.3"},
+			false,
+		},
+		{
+			"no match",
+			"$.hosts[5].address",
+			nil,
+			false,
+		},
+		{
+			"index into object",
+			"$.primary[0]",
+			nil,
+			false,
+		},
+		{
+			"missing root",
+			"hosts[*]",
+			nil,
+			true,
+		},
+		{
+			"empty member name",
+			"$..address",
+			nil,
+			true,
+		},
+		{
+			"invalid index",
+			"$.hosts[-1]",
+			nil,
+			true,
+		},
+		{
+			"unterminated bracket",
+			"$.hosts[0",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := compileJSONPath(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compileJSONPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := p.eval(v); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jsonPath.eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewKubernetesClient creates a Kubernetes clientset from a kubeconfig file,
+// or from the in-cluster config if kubeconfig is empty
+func NewKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// KubernetesFetcher implements Fetcher to retrieve the ready IPv4 addresses
+// of a Kubernetes service, by watching its EndpointSlices
+type KubernetesFetcher struct {
+	namespace string
+	name      string
+
+	client  kubernetes.Interface
+	watcher watch.Interface
+	slices  map[string]*discoveryv1.EndpointSlice
+
+	fetched bool
+	last    []string
+
+	lastSuccess int64
+	delay       uint64
+
+	backoff func(*uint64)
+	reset   func(*uint64)
+
+	logger hclog.Logger
+}
+
+// splitKubernetesService returns the namespace and name of a service given
+// as namespace/name
+func splitKubernetesService(service string) (string, string, error) {
+	parts := strings.SplitN(service, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("Kubernetes service must be given as namespace/name")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// NewKubernetesFetcher creates a KubernetesFetcher for a service given as
+// namespace/name
+func NewKubernetesFetcher(service string, client kubernetes.Interface, logger hclog.Logger) (Fetcher, error) {
+	namespace, name, err := splitKubernetesService(service)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff, reset := backoffFuncs()
+
+	return &KubernetesFetcher{
+		namespace: namespace,
+		name:      name,
+		client:    client,
+		slices:    make(map[string]*discoveryv1.EndpointSlice),
+		backoff:   backoff,
+		reset:     reset,
+		logger:    logger.With("kubernetes_service", service),
+	}, nil
+}
+
+// Fetch returns the ready addresses of the service. The first call returns
+// immediately; subsequent calls block until the ready addresses change.
+func (k *KubernetesFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	for {
+		if err := k.sync(ctx); err != nil {
+			k.logger.Error("Failed to watch EndpointSlices", "error", err)
+			fetchError.WithLabelValues(service, backendKubernetes).Inc()
+
+			k.stop()
+			k.backoff(&k.delay)
+			continue
+		}
+		k.reset(&k.delay)
+		atomic.StoreInt64(&k.lastSuccess, time.Now().UnixNano())
+
+		addresses := readyAddresses(k.slices)
+		if !k.fetched || !reflect.DeepEqual(addresses, k.last) {
+			k.fetched = true
+			k.last = addresses
+			return &FetchResult{
+				Addresses: addresses,
+				Changed:   time.Now(),
+			}
+		}
+	}
+}
+
+// sync lists the service's EndpointSlices and starts a watch if no watch is
+// running, and otherwise applies the next watch event
+func (k *KubernetesFetcher) sync(ctx context.Context) error {
+	opts := metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + k.name,
+	}
+
+	if k.watcher == nil {
+		list, err := k.client.DiscoveryV1().EndpointSlices(k.namespace).List(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		k.slices = make(map[string]*discoveryv1.EndpointSlice)
+		for i := range list.Items {
+			k.slices[list.Items[i].Name] = &list.Items[i]
+		}
+
+		opts.ResourceVersion = list.ResourceVersion
+		opts.AllowWatchBookmarks = true
+		k.watcher, err = k.client.DiscoveryV1().EndpointSlices(k.namespace).Watch(ctx, opts)
+		return err
+	}
+
+	event, ok := <-k.watcher.ResultChan()
+	if !ok {
+		// the watch timed out; list again and start a new watch
+		k.stop()
+		return nil
+	}
+
+	switch event.Type {
+	case watch.Error:
+		return apierrors.FromObject(event.Object)
+	case watch.Added, watch.Modified, watch.Deleted, watch.Bookmark:
+		slice, ok := event.Object.(*discoveryv1.EndpointSlice)
+		if !ok {
+			return nil
+		}
+
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			k.slices[slice.Name] = slice
+		case watch.Deleted:
+			delete(k.slices, slice.Name)
+		}
+	}
+
+	return nil
+}
+
+func (k *KubernetesFetcher) stop() {
+	if k.watcher != nil {
+		k.watcher.Stop()
+		k.watcher = nil
+	}
+}
+
+// readyAddresses returns the sorted, unique IPv4 addresses of the ready
+// endpoints in a set of EndpointSlices. As specified by the EndpointSlice
+// API, an endpoint with no ready condition is ready.
+func readyAddresses(slices map[string]*discoveryv1.EndpointSlice) []string {
+	seen := make(map[string]bool)
+	addresses := []string{}
+
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 {
+			continue
+		}
+
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+
+			for _, a := range e.Addresses {
+				if !seen[a] {
+					seen[a] = true
+					addresses = append(addresses, a)
+				}
+			}
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// Status returns the current state of the connection to Kubernetes
+func (k *KubernetesFetcher) Status() FetcherStatus {
+	var last time.Time
+	if n := atomic.LoadInt64(&k.lastSuccess); n != 0 {
+		last = time.Unix(0, n)
+	}
+
+	delay := atomic.LoadUint64(&k.delay)
+
+	return FetcherStatus{
+		LastSuccess:       last,
+		ConsecutiveErrors: delay,
+		Backoff:           backoffDuration(delay),
+	}
+}
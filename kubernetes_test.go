@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func endpointSlice(name string, addressType discoveryv1.AddressType, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: "web",
+			},
+		},
+		AddressType: addressType,
+		Endpoints:   endpoints,
+	}
+}
+
+func endpoint(address string, ready *bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{address},
+		Conditions: discoveryv1.EndpointConditions{Ready: ready},
+	}
+}
+
+func Test_readyAddresses(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		name   string
+		slices []*discoveryv1.EndpointSlice
+		want   []string
+	}{
+		{
+			"ready endpoints",
+			[]*discoveryv1.EndpointSlice{
+				endpointSlice("web-1", discoveryv1.AddressTypeIPv4,
+					endpoint("10.0.0.2", &yes),
+					endpoint("10.0.0.1", nil),
+					endpoint("10.0.0.3", &no),
+				),
+			},
+			[]string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			"multiple slices",
+			[]*discoveryv1.EndpointSlice{
+				endpointSlice("web-1", discoveryv1.AddressTypeIPv4, endpoint("10.0.0.1", &yes)),
+				endpointSlice("web-2", discoveryv1.AddressTypeIPv4, endpoint("10.0.0.2", &yes), endpoint("10.0.0.1", &yes)),
+			},
+			[]string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			"IPv6 slice",
+			[]*discoveryv1.EndpointSlice{
+				endpointSlice("web-1", discoveryv1.AddressTypeIPv6, endpoint("fd00::1", &yes)),
+			},
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slices := make(map[string]*discoveryv1.EndpointSlice)
+			for _, s := range tt.slices {
+				slices[s.Name] = s
+			}
+
+			if got := readyAddresses(slices); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readyAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubernetesFetcher_Fetch(t *testing.T) {
+	yes, no := true, false
+	ctx := context.Background()
+
+	client := fake.NewSimpleClientset(
+		endpointSlice("web-1", discoveryv1.AddressTypeIPv4, endpoint("10.0.0.1", &yes), endpoint("10.0.0.2", &yes)),
+	)
+
+	f, err := NewKubernetesFetcher("default/web", client, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewKubernetesFetcher() error = %v", err)
+	}
+
+	if got := f.Fetch(ctx, "web").Addresses; !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Fetch() = %v, want initial addresses", got)
+	}
+
+	resultCh := make(chan *FetchResult, 1)
+	go func() {
+		resultCh <- f.Fetch(ctx, "web")
+	}()
+
+	_, err = client.DiscoveryV1().EndpointSlices("default").Update(ctx,
+		endpointSlice("web-1", discoveryv1.AddressTypeIPv4, endpoint("10.0.0.1", &no), endpoint("10.0.0.2", &yes)),
+		metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	select {
+	case res := <-resultCh:
+		if !reflect.DeepEqual(res.Addresses, []string{"10.0.0.2"}) {
+			t.Errorf("Fetch() = %v, want changed addresses", res.Addresses)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Fetch() did not return for a changed EndpointSlice")
+	}
+}
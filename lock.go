@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LockFetcher implements Fetcher to retrieve the address of the node holding
+// a Consul lock, as acquired by `consul lock`, provided the node has a
+// passing instance of a given service. The lock key and the service's health
+// are both watched with blocking queries.
+type LockFetcher struct {
+	*ConsulFetcher
+
+	key     string
+	kvIndex uint64
+
+	holder  string
+	entries []*api.ServiceEntry
+}
+
+// lockResult is the result of a query for the lock key or service health
+type lockResult struct {
+	pair    *api.KVPair
+	entries []*api.ServiceEntry
+	index   uint64
+	err     error
+}
+
+// NewLockFetcher creates a LockFetcher for a given service and lock key
+func NewLockFetcher(service, key string, options ConsulOptions, logger hclog.Logger) (Fetcher, error) {
+	c, err := newConsulFetcher(service, options, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LockFetcher{
+		ConsulFetcher: c,
+		key:           key,
+	}, nil
+}
+
+// Fetch waits for a change to the lock holder or the service's health, and
+// returns the address of the lock holder's node if it is healthy. The
+// returned addresses are empty if the lock is not held, or its holder is
+// not healthy.
+func (l *LockFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	for {
+		_, span := tracer().Start(ctx, spanConsul, trace.WithAttributes(
+			attribute.String("service", service),
+			attribute.String("consul.lock_key", l.key),
+		))
+
+		kvIndex, healthIndex := l.kvIndex, l.ConsulFetcher.wait
+		err := l.watch(ctx, service)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+
+			l.logger.Error("Failed to fetch lock holder", "key", l.key, "error", err)
+			consulMonitorError.WithLabelValues(service).Inc()
+			fetchError.WithLabelValues(service, backendConsul).Inc()
+
+			_, bspan := tracer().Start(ctx, spanBackoff, trace.WithAttributes(
+				attribute.Int64("backoff.attempt", int64(atomic.LoadUint64(&l.delay)+1)),
+			))
+			l.backoff(&l.delay)
+			bspan.End()
+			continue
+		}
+		l.reset(&l.delay)
+		atomic.StoreInt64(&l.lastSuccess, time.Now().UnixNano())
+
+		res := &FetchResult{
+			Addresses: lockHolderAddress(l.holder, l.entries, l.options.TaggedAddress),
+		}
+		if l.kvIndex != kvIndex || l.ConsulFetcher.wait != healthIndex {
+			res.Changed = time.Now()
+		}
+
+		span.SetAttributes(
+			attribute.String("consul.lock_holder", l.holder),
+			attribute.Int("healthy", len(res.Addresses)),
+		)
+		span.End()
+
+		return res
+	}
+}
+
+// watch blocks until either the lock key or the service's health changes.
+// On the first call, both are fetched without blocking.
+func (l *LockFetcher) watch(ctx context.Context, service string) error {
+	if l.kvIndex == 0 || l.ConsulFetcher.wait == 0 {
+		kv := l.queryLock(ctx)
+		if kv.err != nil {
+			return kv.err
+		}
+		health := l.queryHealth(ctx, service)
+		if health.err != nil {
+			return health.err
+		}
+
+		return l.apply(kv, health)
+	}
+
+	qctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	kvCh := make(chan lockResult, 1)
+	healthCh := make(chan lockResult, 1)
+	go func() { kvCh <- l.queryLock(qctx) }()
+	go func() { healthCh <- l.queryHealth(qctx, service) }()
+
+	select {
+	case kv := <-kvCh:
+		if kv.err != nil {
+			return kv.err
+		}
+		return l.apply(kv, lockResult{})
+	case health := <-healthCh:
+		if health.err != nil {
+			return health.err
+		}
+		return l.apply(lockResult{}, health)
+	}
+}
+
+func (l *LockFetcher) queryLock(ctx context.Context) lockResult {
+	pair, meta, err := l.client.KV().Get(l.key, (&api.QueryOptions{
+		Datacenter: l.options.Datacenter,
+		WaitIndex:  l.kvIndex,
+	}).WithContext(ctx))
+	if err != nil {
+		return lockResult{err: err}
+	}
+
+	return lockResult{pair: pair, index: meta.LastIndex}
+}
+
+func (l *LockFetcher) queryHealth(ctx context.Context, service string) lockResult {
+	timer := prometheus.NewTimer(consulFetchDuration.WithLabelValues(service))
+	entries, meta, err := l.client.Health().Service(service, "", true, (&api.QueryOptions{
+		Datacenter: l.options.Datacenter,
+		WaitIndex:  l.ConsulFetcher.wait,
+	}).WithContext(ctx))
+	if ctx.Err() == nil {
+		// queries cancelled by a change to the lock are not observed
+		timer.ObserveDuration()
+	}
+	if err != nil {
+		return lockResult{err: err}
+	}
+
+	return lockResult{entries: entries, index: meta.LastIndex}
+}
+
+// apply updates the lock holder and service health from the results of
+// queries. A zero index denotes a query that was not made.
+func (l *LockFetcher) apply(kv, health lockResult) error {
+	if kv.index != 0 {
+		holder := ""
+		if kv.pair != nil && kv.pair.Session != "" {
+			session, _, err := l.client.Session().Info(kv.pair.Session, &api.QueryOptions{
+				Datacenter: l.options.Datacenter,
+			})
+			if err != nil {
+				return err
+			}
+			if session != nil {
+				holder = session.Node
+			}
+		}
+
+		if holder != l.holder {
+			l.logger.Info("Lock holder changed", "key", l.key, "node", holder)
+		}
+		l.holder = holder
+		l.kvIndex = kv.index
+	}
+
+	if health.index != 0 {
+		l.setIndex(l.service, health.index)
+		l.entries = health.entries
+	}
+
+	return nil
+}
+
+// lockHolderAddress returns the address of a lock holder's node, if it is
+// among the nodes with a healthy instance of the service
+func lockHolderAddress(node string, entries []*api.ServiceEntry, tag string) []string {
+	if node == "" {
+		return []string{}
+	}
+
+	for _, e := range entries {
+		if e.Node.Node == node {
+			return []string{entryAddress(e, tag)}
+		}
+	}
+
+	return []string{}
+}
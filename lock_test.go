@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func Test_lockHolderAddress(t *testing.T) {
+	entries := []*api.ServiceEntry{
+		{Node: &api.Node{Node: "db1", Address: "10.0.0.1"}},
+		{Node: &api.Node{Node: "db2", Address: "10.0.0.2"}},
+	}
+
+	tests := []struct {
+		name    string
+		node    string
+		entries []*api.ServiceEntry
+		want    []string
+	}{
+		{
+			"healthy holder",
+			"db2",
+			entries,
+			[]string{"10.0.0.2"},
+		},
+		{
+			"unhealthy holder",
+			"db3",
+			entries,
+			[]string{},
+		},
+		{
+			"lock not held",
+			"",
+			entries,
+			[]string{},
+		},
+		{
+			"no healthy nodes",
+			"db1",
+			nil,
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lockHolderAddress(tt.node, tt.entries, ""); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lockHolderAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// NewLogger creates the root logger for hobson at a given level, emitting
+// either text or JSON formatted lines. An empty level defaults to info.
+func NewLogger(level, format string) hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       "hobson",
+		Level:      hclog.LevelFromString(level),
+		JSONFormat: format == "json",
+	})
+}
+
+// fatal logs a message at the error level and exits
+func fatal(logger hclog.Logger, msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -3,115 +3,453 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"path"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/hashicorp/go-hclog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"k8s.io/client-go/kubernetes"
 )
 
 func main() {
 	configPath := flag.String("config", "", "Config file path")
 	flag.Parse()
+
+	logger := NewLogger("", "")
 	if *configPath == "" {
-		log.Fatalln("-config must be set")
+		fatal(logger, "-config must be set")
 	}
 
 	config, err := NewConfig(*configPath)
 	if err != nil {
-		log.Fatalln("Error loading config:", err)
+		fatal(logger, "Error loading config", "error", err)
+	}
+	logger = NewLogger(config.LogLevel, config.LogFormat)
+
+	var tp *sdktrace.TracerProvider
+	if config.Tracing.Endpoint != "" {
+		tp, err = NewTracerProvider(config.Tracing)
+		if err != nil {
+			fatal(logger, "Failed to setup tracing", "error", err)
+		}
+	}
+
+	var kube kubernetes.Interface
+	if config.Backend == backendKubernetes {
+		kube, err = NewKubernetesClient(config.Kubernetes.Kubeconfig)
+		if err != nil {
+			fatal(logger, "Failed to setup Kubernetes client", "error", err)
+		}
+	}
+
+	var etcd *clientv3.Client
+	if config.Backend == backendEtcd {
+		etcd, err = NewEtcdClient(config.Etcd)
+		if err != nil {
+			fatal(logger, "Failed to setup etcd client", "error", err)
+		}
+	}
+
+	// backendFetcher creates the Fetcher for a service in a view; the
+	// default view is the zero ViewConfig
+	backendFetcher := func(service string, view ViewConfig, logger hclog.Logger) (Fetcher, error) {
+		options := ConsulOptions{
+			Datacenter:           view.Datacenter,
+			EstimateCheckChanges: config.EstimateCheckPropagation,
+			TaggedAddress:        view.TaggedAddress,
+		}
+		if config.Geo.Enabled() && view.Name == "" {
+			options.RegionMeta = config.Geo.NodeMeta
+		}
+
+		switch config.Backend {
+		case backendFile:
+			return NewFileFetcher(service, config.File, logger)
+		case backendKubernetes:
+			name := config.ServiceConfig[service].KubernetesService
+			if name == "" {
+				name = config.Kubernetes.Namespace + "/" + service
+			}
+			return NewKubernetesFetcher(name, kube, logger)
+		case backendEtcd:
+			prefix := config.ServiceConfig[service].EtcdPrefix
+			if prefix == "" {
+				prefix = path.Join(config.Etcd.Prefix, service)
+			}
+			return NewEtcdFetcher(prefix, etcd, logger)
+		case backendNomad:
+			return NewNomadFetcher(service, config.Nomad, logger)
+		case backendHTTP:
+			url := config.ServiceConfig[service].HTTPURL
+			if url == "" {
+				url = httpBackendURL(config.HTTPBackend.URL, service)
+			}
+			return NewHTTPFetcher(url, config.HTTPBackend, logger)
+		}
+
+		sc := config.ServiceConfig[service]
+		selection := sc.Selection
+		if view.Selection != "" {
+			selection = view.Selection
+		}
+
+		switch selection {
+		case selectionLock:
+			return NewLockFetcher(service, sc.LockKey, options, logger)
+		case selectionNearest:
+			return NewNearestFetcher(service, sc.NearestNode, config.nearestThreshold(service), options, logger)
+		}
+		return NewConsulFetcher(service, options, logger)
+	}
+
+	fetcher := func(view ViewConfig) func(string, hclog.Logger) (Fetcher, error) {
+		return func(service string, logger hclog.Logger) (Fetcher, error) {
+			f, err := backendFetcher(service, view, logger)
+			if err != nil {
+				return nil, err
+			}
+
+			if probe := config.ServiceConfig[service].Probe; probe != nil {
+				return NewProbeFetcher(service, f, *probe, logger)
+			}
+			return f, nil
+		}
+	}
+
+	m, err := NewMonitor(config.Services, logger.Named("monitor"))
+	m.Fetcher = fetcher(ViewConfig{})
+	if err != nil {
+		fatal(logger, "Failed to setup monitor", "error", err)
+	}
+
+	health := NewHealth(config.Health, m)
+
+	history, err := NewHistory(config.History.Size, config.History.Path, logger.Named("history"))
+	if err != nil {
+		fatal(logger, "Failed to setup history", "error", err)
 	}
 
 	srv := NewDNSServer(config.Bind)
-	h := NewDNSHandler(config.Zone)
+	h := NewDNSHandler(config.Zone, logger.Named("dns"))
+	h.AddListener(history)
 	srv.Handler = h
+	srv.NotifyStartedFunc = health.SetDNSBound
+
+	var tap *DnstapHandler
+	if config.Dnstap.Enabled() {
+		o, err := NewDnstapOutput(config.Dnstap, logger.Named("dnstap"))
+		if err != nil {
+			fatal(logger, "Failed to setup dnstap output", "error", err)
+		}
+		tap = NewDnstapHandler(h, o, config.Dnstap.Identity, config.Dnstap.BufferSize, logger.Named("dnstap"))
+		tap.Run()
+		srv.Handler = tap
+	}
+
+	var webhooks []*Webhook
+	for _, wc := range config.Webhooks {
+		w, err := NewWebhook(wc, logger.Named("webhook"))
+		if err != nil {
+			fatal(logger, "Failed to setup webhook", "error", err)
+		}
+		w.Run()
+		h.AddListener(w)
+		webhooks = append(webhooks, w)
+	}
+
+	if config.Geo.Enabled() {
+		loc, err := NewLocator(config.Geo)
+		if err != nil {
+			fatal(logger, "Failed to setup geo locator", "error", err)
+		}
+
+		listeners := []ChangeListener{history}
+		for _, w := range webhooks {
+			listeners = append(listeners, w)
+		}
+		h.SetLocator(loc, listeners...)
+	}
+
+	if err := h.SetECSTrustedNetworks(config.ECSTrustedNetworks); err != nil {
+		fatal(logger, "Failed to set ECS trusted networks", "error", err)
+	}
+
+	var views []*View
+	for _, vc := range config.Views {
+		v, err := NewView(vc, config.Zone, config.Services, fetcher(vc), logger)
+		if err != nil {
+			fatal(logger, "Failed to setup view", "view", vc.Name, "error", err)
+		}
+		v.AddListener(history)
+		for _, w := range webhooks {
+			v.AddListener(w)
+		}
+		h.AddView(v)
+		health.AddMonitor(v.monitor)
+		views = append(views, v)
+	}
+
+	var pub *Publisher
+	if config.Publish.Enabled {
+		pub, err = NewPublisher(config.Publish, logger.Named("publish"))
+		if err != nil {
+			fatal(logger, "Failed to setup publisher", "error", err)
+		}
+		pub.Run()
+		h.AddListener(pub)
+	}
+
+	var deriver *Deriver
+	if config.Derived.Enabled {
+		deriver, err = NewDeriver(config.Derived, logger.Named("derived"))
+		if err != nil {
+			fatal(logger, "Failed to setup derived services", "error", err)
+		}
+		deriver.Run()
+		h.AddListener(deriver)
+	}
+
+	var coord *Coordinator
+	if config.HA.Enabled {
+		coord, err = NewCoordinator(config.HA, config.Services, h, logger.Named("ha"))
+		if err != nil {
+			fatal(logger, "Failed to setup coordination", "error", err)
+		}
+		h.AddListener(coord)
+	}
+
+	var hooks []*ExecHook
+	for service, sc := range config.ServiceConfig {
+		if len(sc.OnChange) == 0 {
+			continue
+		}
+
+		e := NewExecHook(service, sc.OnChange, sc.OnChangeTimeout, logger.Named("hook"))
+		e.Run()
+		h.AddListener(e)
+		hooks = append(hooks, e)
+	}
 
 	go func() {
-		log.Println("Answer queries for zone", config.Zone)
-		log.Println("Starting DNS server on", config.Bind)
+		logger.Info("Starting DNS server", "zone", config.Zone, "bind", config.Bind)
 		if err := srv.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to set udp listener %s\n", err.Error())
+			fatal(logger, "Failed to set udp listener", "error", err)
 		}
 	}()
 
 	notify := make(chan *RecordEntry)
-	m, err := NewMonitor(config.Services)
-	m.Fetcher = NewConsulFetcher
-	if err != nil {
-		log.Fatalln("Failed to setup monitor:", err)
-	}
 
-	log.Printf("Beginning monitoring of Consul services (%s)",
-		strings.Join(config.Services, ","))
+	logger.Info("Beginning monitoring of services",
+		"services", config.Services, "backend", config.Backend)
 
 	err = m.Run(notify)
 	if err != nil {
-		log.Fatalln("Failed to monitor services:", err)
+		fatal(logger, "Failed to monitor services", "error", err)
 	}
 	h.Watch(notify)
 
-	p := NewMetricsHandler(config.PromBind)
+	for _, v := range views {
+		if err := v.Run(); err != nil {
+			fatal(logger, "Failed to monitor services", "view", v.Name, "error", err)
+		}
+	}
+
+	if coord != nil {
+		coord.Run()
+	}
+
+	var reg *Registration
+	if config.Registration.Enabled {
+		reg, err = NewRegistration(config.Registration, config.Bind, config.Zone, config.Services[0], logger.Named("registration"))
+		if err != nil {
+			fatal(logger, "Failed to setup registration", "error", err)
+		}
+		if err := reg.Run(); err != nil {
+			fatal(logger, "Failed to register in Consul", "error", err)
+		}
+	}
+
+	p := NewMetricsHandler(config.PromBind, config.HTTP)
 	p.RegisterPrometheus()
+	p.RegisterMonitor(m)
+	for _, v := range views {
+		p.RegisterMonitor(v.monitor)
+	}
+	p.RegisterHealth(health)
+	p.RegisterHistory(history)
+	if config.Admin.Enabled {
+		p.RegisterAdmin(h)
+	}
 	go func() {
-		log.Println("Exporting Prometheus metrics on", config.PromBind)
+		logger.Info("Exporting Prometheus metrics", "bind", config.PromBind)
 		if err := p.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalln("Failed to start Prometheus exposition server:", err)
+			fatal(logger, "Failed to start Prometheus exposition server", "error", err)
 		}
 	}()
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down...")
+	logger.Info("Shutting down...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 
 	waitCh := make(chan struct{})
 	var wg sync.WaitGroup
+
+	// deregister before the DNS server stops, so instances are not
+	// discovered while shutting down
+	if reg != nil {
+		if err := reg.Shutdown(ctx); err != nil {
+			logger.Error("Error deregistering from Consul", "error", err)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.ShutdownContext(ctx); err != nil {
+			logger.Error("Error shutting down DNS server", "error", err)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := h.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down DNS handler", "error", err)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := m.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down monitor", "error", err)
+		}
+	}()
+
+	for _, v := range views {
+		wg.Add(1)
+		go func(v *View) {
+			defer wg.Done()
+			if err := v.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down view", "view", v.Name, "error", err)
+			}
+		}(v)
+	}
+
+	if etcd != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := etcd.Close(); err != nil {
+				logger.Error("Error closing etcd client", "error", err)
+			}
+		}()
+	}
+
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
+		if err := p.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down Prometheus exposition server", "error", err)
+		}
+	}()
+
+	if tap != nil {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := srv.ShutdownContext(ctx); err != nil {
-				log.Println("Error shutting down DNS server:", err)
+			if err := tap.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down dnstap", "error", err)
 			}
 		}()
+	}
 
+	if tp != nil {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := h.Shutdown(ctx); err != nil {
-				log.Println("Error shutting down DNS handler:", err)
+			if err := tp.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down tracing", "error", err)
 			}
 		}()
+	}
+
+	if deriver != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := deriver.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down derived services", "error", err)
+			}
+		}()
+	}
 
+	if coord != nil {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := m.Shutdown(ctx); err != nil {
-				log.Println("Error shutting down monitor:", err)
+			if err := coord.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down coordination", "error", err)
 			}
 		}()
+	}
 
+	if pub != nil {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := p.Shutdown(ctx); err != nil {
-				log.Println("Error shutting down Prometheus exposition server:", err)
+			if err := pub.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down publisher", "error", err)
 			}
 		}()
+	}
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := history.Shutdown(ctx); err != nil {
+			logger.Error("Error shutting down history", "error", err)
+		}
+	}()
+
+	for _, w := range webhooks {
+		wg.Add(1)
+		go func(w *Webhook) {
+			defer wg.Done()
+			if err := w.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down webhook", "error", err)
+			}
+		}(w)
+	}
+
+	for _, e := range hooks {
+		wg.Add(1)
+		go func(e *ExecHook) {
+			defer wg.Done()
+			if err := e.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down hook", "error", err)
+			}
+		}(e)
+	}
+
+	go func() {
 		wg.Wait()
 		close(waitCh)
 	}()
 
 	select {
 	case <-ctx.Done():
-		log.Fatalln("Timeout while shutting down server")
+		fatal(logger, "Timeout while shutting down server")
 	case <-waitCh:
 	}
 }
@@ -2,21 +2,195 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"fmt"
+	"html"
 	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// unknownServiceLabel is used as the service label for queries for names that
+// hobson does not serve, to bound the cardinality of per-service metrics.
+// Consul service names cannot contain underscores, so this cannot collide
+// with a monitored service.
+const unknownServiceLabel = "_unknown"
+
+// livenessPath is the path of the liveness endpoint
+const livenessPath = "/healthz"
+
+// bearerPrefix is the prefix of an Authorization header holding a bearer token
+const bearerPrefix = "Bearer "
+
+// qtypeLabels bounds the cardinality of the qtype label; other query types
+// are recorded as "other"
+var qtypeLabels = map[uint16]string{
+	dns.TypeA:     "A",
+	dns.TypeAAAA:  "AAAA",
+	dns.TypeANY:   "ANY",
+	dns.TypeCNAME: "CNAME",
+	dns.TypeMX:    "MX",
+	dns.TypeNS:    "NS",
+	dns.TypePTR:   "PTR",
+	dns.TypeSOA:   "SOA",
+	dns.TypeSRV:   "SRV",
+	dns.TypeTXT:   "TXT",
+}
+
+func qtypeLabel(qtype uint16) string {
+	if l, ok := qtypeLabels[qtype]; ok {
+		return l
+	}
+
+	return "other"
+}
+
 var (
+	consulFetchDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hobson_consul_fetch_duration_seconds",
+			Help:    "Histogram of the duration of Consul health queries, including blocking time",
+			Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+		},
+		[]string{"service"},
+	)
+
+	consulIndex = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hobson_consul_index",
+			Help: "Raft index returned by the most recent Consul health query",
+		},
+		[]string{"service"},
+	)
+
+	consulLastContact = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hobson_consul_last_contact_seconds",
+			Help: "Time since the Consul server answering the most recent health query was in contact with the leader",
+		},
+		[]string{"service"},
+	)
+
 	consulMonitorError = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hobson_consul_monitor_error_total",
-			Help: "Count of errors seen when fetching service status",
+			Help: "Count of errors seen when fetching service status from Consul, also counted by hobson_fetch_error_total",
+		},
+		[]string{"service"},
+	)
+
+	derivedRegistration = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hobson_derived_registration_total",
+			Help: "Count of derived Consul service registrations by service and result",
+		},
+		[]string{"service", "result"},
+	)
+
+	dnstapDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hobson_dnstap_dropped_total",
+			Help: "Count of dnstap messages dropped due to a full buffer",
+		},
+	)
+
+	failoverTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hobson_failover_total",
+			Help: "Count of failovers of the record served for a service, by reason",
+		},
+		[]string{"service", "reason"},
+	)
+
+	checkPropagationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hobson_failover_check_propagation_seconds",
+			Help:    "Histogram of the estimated time from a health check status change to the served record changing",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2.5, 14),
+		},
+		[]string{"service"},
+	)
+
+	propagationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hobson_failover_propagation_seconds",
+			Help:    "Histogram of the time from a backend change reaching hobson to the served record changing",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2.5, 14),
+		},
+		[]string{"service"},
+	)
+
+	fetchError = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hobson_fetch_error_total",
+			Help: "Count of errors seen when fetching service status, by backend",
+		},
+		[]string{"service", "backend"},
+	)
+
+	haLeader = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hobson_ha_leader",
+			Help: "Whether this instance leads record selection for a service",
 		},
 		[]string{"service"},
 	)
 
+	hookDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "hobson_hook_duration_seconds",
+			Help: "Histogram of the run duration of on_change hooks",
+		},
+		[]string{"service"},
+	)
+
+	hookRun = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hobson_hook_run_total",
+			Help: "Count of on_change hook runs by result",
+		},
+		[]string{"service", "result"},
+	)
+
+	kvPublish = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hobson_kv_publish_total",
+			Help: "Count of selections published to Consul KV by service and result",
+		},
+		[]string{"service", "result"},
+	)
+
+	probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "hobson_probe_duration_seconds",
+			Help: "Histogram of the duration of active health probes",
+		},
+		[]string{"service"},
+	)
+
+	probeTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hobson_probe_total",
+			Help: "Count of active health probes, by probe type and result",
+		},
+		[]string{"service", "type", "result"},
+	)
+
+	probeUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hobson_probe_up",
+			Help: "Whether an address is considered up by active health probes",
+		},
+		[]string{"service", "address"},
+	)
+
 	queryHandleDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "hobson_query_handle_duration",
@@ -25,6 +199,14 @@ var (
 		},
 	)
 
+	queryTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hobson_query_total",
+			Help: "Count of queries by service, query type and response code",
+		},
+		[]string{"service", "qtype", "rcode"},
+	)
+
 	queryUnknownName = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "hobson_query_unknown_name_total",
@@ -40,6 +222,14 @@ var (
 		[]string{"service"},
 	)
 
+	recordSelected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hobson_record_selected_info",
+			Help: "The address currently served for a service",
+		},
+		[]string{"service", "address"},
+	)
+
 	recordUpdateTime = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "hobson_record_last_updated_timestamp",
@@ -47,53 +237,281 @@ var (
 		},
 		[]string{"service"},
 	)
+
+	serviceHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hobson_service_healthy_instances",
+			Help: "Number of healthy instances of a service",
+		},
+		[]string{"service"},
+	)
+
+	webhookNotification = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hobson_webhook_notification_total",
+			Help: "Count of webhook notifications by delivery result",
+		},
+		[]string{"result"},
+	)
 )
 
-// MetricsHandler wraps a Prometheus metrics exporter
+// MetricsHandler wraps a Prometheus metrics exporter, and serves hobson's
+// other HTTP endpoints from a dedicated ServeMux
 type MetricsHandler struct {
-	http *http.Server
+	http     *http.Server
+	mux      *http.ServeMux
+	registry *prometheus.Registry
+	config   HTTPConfig
+
+	mu       sync.Mutex
+	links    []indexLink
+	backends *backendCollector
+}
+
+type indexLink struct {
+	path  string
+	title string
 }
 
 // NewMetricsHandler creates a MetricsHandler object and prepares a Prometheus
-// metrics exposition handler
-func NewMetricsHandler(bind string) *MetricsHandler {
-	prom := promhttp.Handler()
-
-	http.HandleFunc("/metrics", prom.ServeHTTP)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-		<head><title>Hobson Metrics</title></head>
-		<body>
-		<h1>Hobson Metrics</h1>
-		<img src="https://upload.wikimedia.org/wikipedia/commons/9/9d/ThomasHobson.jpg"/>
-		<p><a href="/metrics">Metrics</a></p>
-		</body>
-		</html>`))
-	})
+// metrics exposition handler backed by its own registry
+func NewMetricsHandler(bind string, config HTTPConfig) *MetricsHandler {
+	m := &MetricsHandler{
+		mux:      http.NewServeMux(),
+		registry: prometheus.NewRegistry(),
+		config:   config,
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	m.handle("/metrics", "Metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.mux.HandleFunc("/", m.serveIndex)
+
+	if config.Pprof {
+		m.handle("/debug/pprof/", "Profiling", http.HandlerFunc(pprof.Index))
+		m.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		m.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		m.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		m.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	m.http = &http.Server{
+		Addr:    bind,
+		Handler: m.authenticate(m.mux),
+	}
+
+	return m
+}
+
+// handle registers a handler on the ServeMux, and links to it from the index page
+func (m *MetricsHandler) handle(path, title string, h http.Handler) {
+	m.mux.Handle(path, h)
+
+	m.mu.Lock()
+	m.links = append(m.links, indexLink{path: path, title: title})
+	m.mu.Unlock()
+}
+
+func (m *MetricsHandler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(`<html>
+<head><title>Hobson</title></head>
+<body>
+<h1>Hobson</h1>
+<p>Failover DNS for Consul SD</p>
+<ul>
+`)
 
-	httpServer := &http.Server{
-		Addr: bind,
+	m.mu.Lock()
+	for _, l := range m.links {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(l.path), html.EscapeString(l.title))
 	}
+	m.mu.Unlock()
+
+	b.WriteString(`</ul>
+</body>
+</html>
+`)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
 
-	return &MetricsHandler{
-		http: httpServer,
+// authenticate wraps a handler, requiring the configured basic auth
+// credentials or bearer token. If neither is configured, requests are
+// passed through unauthenticated. The liveness endpoint is never
+// authenticated, so that it can be used by orchestrator probes.
+func (m *MetricsHandler) authenticate(next http.Handler) http.Handler {
+	if m.config.Username == "" && m.config.BearerToken == "" {
+		return next
 	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == livenessPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if m.config.BearerToken != "" {
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, bearerPrefix) &&
+				secureCompare(strings.TrimPrefix(auth, bearerPrefix), m.config.BearerToken) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if m.config.Username != "" {
+			if user, pass, ok := r.BasicAuth(); ok && secureCompare(user, m.config.Username) && secureCompare(pass, m.config.Password) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="hobson"`)
+		}
+
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
 // RegisterPrometheus registers the current global Prometheus metrics variables
-// into the global Prometheus registry within hobson
+// into the MetricsHandler's registry
 func (m *MetricsHandler) RegisterPrometheus() {
-	prometheus.MustRegister(
+	m.registry.MustRegister(
+		consulFetchDuration,
+		consulIndex,
+		consulLastContact,
 		consulMonitorError,
+		checkPropagationDuration,
+		derivedRegistration,
+		dnstapDropped,
+		failoverTotal,
+		fetchError,
+		haLeader,
+		hookDuration,
+		hookRun,
+		kvPublish,
+		probeDuration,
+		probeTotal,
+		probeUp,
+		propagationDuration,
 		queryHandleDuration,
+		queryTotal,
 		queryUnknownName,
+		recordSelected,
 		recordServed,
 		recordUpdateTime,
+		serviceHealthy,
+		webhookNotification,
 	)
 }
 
-// ListenAndServe wraps the underlying net/http ListenAndServe call
+// backendCollector exports the time since the last successful fetch, and
+// since the backend's index last advanced, for each service monitored by a
+// set of Monitors
+type backendCollector struct {
+	mu       sync.Mutex
+	monitors []*Monitor
+
+	desc      *prometheus.Desc
+	indexDesc *prometheus.Desc
+}
+
+func newBackendCollector() *backendCollector {
+	return &backendCollector{
+		desc: prometheus.NewDesc(
+			"hobson_backend_last_success_age_seconds",
+			"Time since the last successful fetch for a service",
+			[]string{"service"},
+			nil,
+		),
+		indexDesc: prometheus.NewDesc(
+			"hobson_consul_index_age_seconds",
+			"Time since the Consul index returned by health queries for a service last advanced",
+			[]string{"service"},
+			nil,
+		),
+	}
+}
+
+func (c *backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+	ch <- c.indexDesc
+}
+
+func (c *backendCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	monitors := c.monitors
+	c.mu.Unlock()
+
+	now := time.Now()
+	for _, m := range monitors {
+		for service, s := range m.Status() {
+			if s.LastSuccess.IsZero() {
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+				now.Sub(s.LastSuccess).Seconds(), service)
+
+			if !s.IndexAdvanced.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.indexDesc, prometheus.GaugeValue,
+					now.Sub(s.IndexAdvanced).Seconds(), service)
+			}
+		}
+	}
+}
+
+// RegisterMonitor registers metrics describing the backends of a given
+// Monitor. Several Monitors, such as those of Views, may be registered.
+func (m *MetricsHandler) RegisterMonitor(mon *Monitor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.backends == nil {
+		m.backends = newBackendCollector()
+		m.registry.MustRegister(m.backends)
+	}
+
+	m.backends.mu.Lock()
+	m.backends.monitors = append(m.backends.monitors, mon)
+	m.backends.mu.Unlock()
+}
+
+// RegisterHealth exposes liveness and backend health endpoints for a given
+// Health object
+func (m *MetricsHandler) RegisterHealth(h *Health) {
+	m.handle(livenessPath, "Liveness", http.HandlerFunc(h.ServeLiveness))
+	m.handle("/health/backends", "Backend Health", http.HandlerFunc(h.ServeBackends))
+}
+
+// RegisterHistory exposes the record change history for a given History object
+func (m *MetricsHandler) RegisterHistory(h *History) {
+	m.handle("/history", "Record History", h)
+}
+
+// RegisterAdmin exposes administrative endpoints for a given DNSHandler
+func (m *MetricsHandler) RegisterAdmin(h *DNSHandler) {
+	m.mux.HandleFunc("/admin/pin", h.ServePin)
+}
+
+// ListenAndServe wraps the underlying net/http ListenAndServe call, serving
+// TLS if a certificate and key are configured
 func (m *MetricsHandler) ListenAndServe() error {
+	if m.config.TLSCertFile != "" {
+		return m.http.ListenAndServeTLS(m.config.TLSCertFile, m.config.TLSKeyFile)
+	}
+
 	return m.http.ListenAndServe()
 }
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestNewMetricsHandler_multiple(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		m := NewMetricsHandler(":0", HTTPConfig{})
+		m.RegisterPrometheus()
+
+		rec := httptest.NewRecorder()
+		m.http.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET /metrics status = %v, want %v", rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestMetricsHandler_RegisterMonitor(t *testing.T) {
+	m := NewMetricsHandler(":0", HTTPConfig{})
+	m.RegisterPrometheus()
+
+	for _, view := range []string{"", "dmz"} {
+		mon, err := NewMonitor([]string{"bar"}, hclog.NewNullLogger())
+		if err != nil {
+			t.Fatalf("NewMonitor() error = %v", err)
+		}
+		mon.view = view
+		mon.fetchers["bar"] = &ChanFetcher{status: FetcherStatus{LastSuccess: time.Now()}}
+
+		m.RegisterMonitor(mon)
+	}
+
+	rec := httptest.NewRecorder()
+	m.http.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, service := range []string{"bar", "bar@dmz"} {
+		want := `hobson_backend_last_success_age_seconds{service="` + service + `"}`
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("GET /metrics does not contain %s", want)
+		}
+	}
+}
+
+func TestMetricsHandler_authenticate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config HTTPConfig
+		path   string
+		setup  func(*http.Request)
+		want   int
+	}{
+		{
+			"no auth configured",
+			HTTPConfig{},
+			"/",
+			func(r *http.Request) {},
+			http.StatusOK,
+		},
+		{
+			"valid basic auth",
+			HTTPConfig{
+				Username: "user",
+				Password: "pass",
+			},
+			"/",
+			func(r *http.Request) {
+				r.SetBasicAuth("user", "pass")
+			},
+			http.StatusOK,
+		},
+		{
+			"invalid basic auth",
+			HTTPConfig{
+				Username: "user",
+				Password: "pass",
+			},
+			"/",
+			func(r *http.Request) {
+				r.SetBasicAuth("user", "nope")
+			},
+			http.StatusUnauthorized,
+		},
+		{
+			"valid bearer token",
+			HTTPConfig{
+				BearerToken: "token",
+			},
+			"/",
+			func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer token")
+			},
+			http.StatusOK,
+		},
+		{
+			"missing bearer token",
+			HTTPConfig{
+				BearerToken: "token",
+			},
+			"/",
+			func(r *http.Request) {},
+			http.StatusUnauthorized,
+		},
+		{
+			"bearer token with basic auth configured",
+			HTTPConfig{
+				Username:    "user",
+				Password:    "pass",
+				BearerToken: "token",
+			},
+			"/",
+			func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer token")
+			},
+			http.StatusOK,
+		},
+		{
+			"bearer token without scheme",
+			HTTPConfig{
+				BearerToken: "token",
+			},
+			"/",
+			func(r *http.Request) {
+				r.Header.Set("Authorization", "token")
+			},
+			http.StatusUnauthorized,
+		},
+		{
+			"liveness without auth",
+			HTTPConfig{
+				Username:    "user",
+				Password:    "pass",
+				BearerToken: "token",
+			},
+			"/healthz",
+			func(r *http.Request) {},
+			http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetricsHandler(":0", tt.config)
+			h := NewHealth(HealthConfig{}, &Monitor{})
+			h.SetDNSBound()
+			m.RegisterHealth(h)
+
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			tt.setup(r)
+
+			rec := httptest.NewRecorder()
+			m.http.Handler.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("GET %s status = %v, want %v", tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -3,11 +3,18 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
 	"math"
+	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const backoffMax = 30000
@@ -15,25 +22,105 @@ const backoffBase = 500
 
 // Fetcher is used to fetch service addresses for a given service
 type Fetcher interface {
-	// Fetch retrieves a slice of addresses for a given service
-	Fetch(string) []string
+	// Fetch retrieves the healthy addresses for a given service. The context
+	// carries the span of the Monitor's fetch, if tracing is enabled.
+	Fetch(context.Context, string) *FetchResult
+}
+
+// FetchResult describes the healthy addresses of a service, and when the
+// backend reported a change to them
+type FetchResult struct {
+	Addresses []string
+
+	// Changed is when the Fetcher observed a change to the service in the
+	// backend, or zero if the service did not change. This is when the
+	// change reached hobson, not when the backend's state changed.
+	Changed time.Time
+
+	// CheckChanged is the estimated time of the earliest health check
+	// status change contributing to this result, or zero if unknown
+	CheckChanged time.Time
+
+	// Reason, if set, is the reason reported when the addresses cause the
+	// served record to change
+	Reason ChangeReason
+
+	// Regions maps addresses to the region of their instance, if known
+	Regions map[string]string
+
+	// Ordered is true if Addresses are in order of preference, in which
+	// case the first address is served rather than the lowest
+	Ordered bool
+}
+
+// ConsulOptions details how a ConsulFetcher queries Consul
+type ConsulOptions struct {
+	// Datacenter to query; an empty Datacenter queries the agent's datacenter
+	Datacenter string
+
+	// EstimateCheckChanges enables estimating when health checks changed
+	// status, from timestamps in the output of checks modified since the
+	// previous query
+	EstimateCheckChanges bool
+
+	// TaggedAddress, if set, is the tagged address of each instance to
+	// return, such as "wan"
+	TaggedAddress string
+
+	// RegionMeta, if set, is the node meta key holding the region of each
+	// instance
+	RegionMeta string
+}
+
+// FetcherStatus describes the state of a Fetcher's connection to its backend
+type FetcherStatus struct {
+	LastSuccess       time.Time
+	ConsecutiveErrors uint64
+	Backoff           time.Duration
+
+	// IndexAdvanced is the time the backend's index last advanced, or zero
+	// for backends without an index
+	IndexAdvanced time.Time
+}
+
+// StatusReporter is implemented by Fetchers that can report the state of their
+// connection to the backend
+type StatusReporter interface {
+	// Status returns the current connectivity state of the Fetcher
+	Status() FetcherStatus
+}
+
+// fetcherShutdown is implemented by Fetchers that run in the background
+// between calls to Fetch, and are stopped when their Monitor shuts down
+type fetcherShutdown interface {
+	Shutdown(context.Context) error
 }
 
 // Monitor provides the ability to watch a number of Consul services and communicate
 // the associated healthy services to a channel-based consumer
 type Monitor struct {
-	Fetcher func(string) (Fetcher, error)
+	Fetcher func(string, hclog.Logger) (Fetcher, error)
 
 	services []string
 
+	// view is the name of the View whose services are monitored, if any
+	view string
+
+	mu       sync.RWMutex
+	fetchers map[string]Fetcher
+
+	logger hclog.Logger
+
 	shutdownCh chan struct{}
 }
 
 // NewMonitor creates a new Monitor object, given a set of Consul
 // services to monitor
-func NewMonitor(services []string) (*Monitor, error) {
+func NewMonitor(services []string, logger hclog.Logger) (*Monitor, error) {
 	m := &Monitor{
 		services:   services,
+		fetchers:   make(map[string]Fetcher),
+		logger:     logger,
 		shutdownCh: make(chan struct{}),
 	}
 
@@ -43,24 +130,36 @@ func NewMonitor(services []string) (*Monitor, error) {
 // ConsulFetcher implements Fetcher to retrieve a list of addresses for a given service
 type ConsulFetcher struct {
 	service string
+	options ConsulOptions
 	client  *api.Client
 
 	wait  uint64
 	delay uint64
 
+	lastSuccess   int64
+	indexAdvanced int64
+
 	backoff func(*uint64)
 	reset   func(*uint64)
+
+	logger hclog.Logger
 }
 
 // NewConsulFetcher creates a ConsulFetcher using the default Consul config.
 // This relies on the Consul SDK's behavior of reading various configs from
 // environment variables.
-func NewConsulFetcher(service string) (Fetcher, error) {
+func NewConsulFetcher(service string, options ConsulOptions, logger hclog.Logger) (Fetcher, error) {
+	return newConsulFetcher(service, options, logger)
+}
+
+func newConsulFetcher(service string, options ConsulOptions, logger hclog.Logger) (*ConsulFetcher, error) {
 	c := &ConsulFetcher{
 		service: service,
+		options: options,
+		logger:  logger.With("datacenter", options.Datacenter),
 	}
 
-	client, err := api.NewClient(api.DefaultConfig())
+	client, err := api.NewClient(api.DefaultConfigWithLogger(logger))
 	if err != nil {
 		return nil, err
 	}
@@ -73,14 +172,20 @@ func NewConsulFetcher(service string) (Fetcher, error) {
 	return c, nil
 }
 
+func backoffDuration(n uint64) time.Duration {
+	if n == 0 {
+		return 0
+	}
+	sleep := math.Min(math.Pow(2, float64(n))*backoffBase, backoffMax)
+	return time.Millisecond * time.Duration(sleep)
+}
+
 func backoffFuncs() (func(*uint64), func(*uint64)) {
 	backoff := func(n *uint64) {
-		*n++
-		sleep := math.Min(math.Pow(2, float64(*n))*backoffBase, backoffMax)
-		time.Sleep(time.Millisecond * time.Duration(sleep))
+		time.Sleep(backoffDuration(atomic.AddUint64(n, 1)))
 	}
 	reset := func(n *uint64) {
-		*n = 0
+		atomic.StoreUint64(n, 0)
 	}
 	return backoff, reset
 }
@@ -88,50 +193,214 @@ func backoffFuncs() (func(*uint64), func(*uint64)) {
 // Fetch retrieves a list of addresses for a Consul service. It uses an exponential
 // backoff to retry on errors, and relies on blocking queries to immediately act
 // on service registration changes.
-func (c *ConsulFetcher) Fetch(service string) []string {
+func (c *ConsulFetcher) Fetch(ctx context.Context, service string) *FetchResult {
 	for {
-		var a []string
+		res := &FetchResult{}
+		prev := c.wait
 
-		svcs, meta, err := c.client.Health().Service(service, "", true, &api.QueryOptions{
-			WaitIndex: c.wait,
+		_, span := tracer().Start(ctx, spanConsul, trace.WithAttributes(
+			attribute.String("service", service),
+			attribute.Int64("consul.wait_index", int64(c.wait)),
+		))
+		timer := prometheus.NewTimer(consulFetchDuration.WithLabelValues(service))
+		svcs, meta, err := c.client.Health().Service(service, "", !c.options.EstimateCheckChanges, &api.QueryOptions{
+			Datacenter: c.options.Datacenter,
+			WaitIndex:  c.wait,
 		})
+		timer.ObserveDuration()
 		if err != nil {
-			log.Println(err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+
+			c.logger.Error("Failed to fetch service health", "error", err)
 			consulMonitorError.WithLabelValues(service).Inc()
+			fetchError.WithLabelValues(service, backendConsul).Inc()
+
+			_, bspan := tracer().Start(ctx, spanBackoff, trace.WithAttributes(
+				attribute.Int64("backoff.attempt", int64(atomic.LoadUint64(&c.delay)+1)),
+			))
 			c.backoff(&c.delay)
+			bspan.End()
 			continue
 		}
 		c.reset(&c.delay)
+		atomic.StoreInt64(&c.lastSuccess, time.Now().UnixNano())
 
 		if meta != nil {
-			c.wait = meta.LastIndex
+			if meta.LastIndex != prev {
+				// a stale read reflects the leader's state as of the last
+				// contact between the answering server and the leader
+				res.Changed = time.Now().Add(-meta.LastContact)
+			}
+
+			c.setIndex(service, meta.LastIndex)
+			consulLastContact.WithLabelValues(service).Set(meta.LastContact.Seconds())
 		}
 
 		for _, svc := range svcs {
-			a = append(a, svc.Node.Address)
+			if c.options.EstimateCheckChanges {
+				if t := checkChangeTime(svc.Checks, prev); !t.IsZero() &&
+					(res.CheckChanged.IsZero() || t.Before(res.CheckChanged)) {
+					res.CheckChanged = t
+				}
+
+				if svc.Checks.AggregatedStatus() != api.HealthPassing {
+					continue
+				}
+			}
+
+			address := entryAddress(svc, c.options.TaggedAddress)
+			res.Addresses = append(res.Addresses, address)
+
+			if c.options.RegionMeta != "" {
+				if res.Regions == nil {
+					res.Regions = make(map[string]string)
+				}
+				res.Regions[address] = svc.Node.Meta[c.options.RegionMeta]
+			}
 		}
 
-		return a
+		span.SetAttributes(
+			attribute.Int64("consul.index", int64(c.wait)),
+			attribute.Int("healthy", len(res.Addresses)),
+		)
+		span.End()
+
+		return res
+	}
+}
+
+// entryAddress returns the address of a service instance. If tag is set,
+// the service's tagged address of that name is preferred, followed by the
+// node's, and then the node's address.
+func entryAddress(e *api.ServiceEntry, tag string) string {
+	if tag != "" {
+		if e.Service != nil {
+			if a, ok := e.Service.TaggedAddresses[tag]; ok && a.Address != "" {
+				return a.Address
+			}
+		}
+		if a := e.Node.TaggedAddresses[tag]; a != "" {
+			return a
+		}
 	}
+
+	return e.Node.Address
+}
+
+var checkTimestamp = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
+
+// checkChangeTime estimates the earliest time at which a check modified after
+// a given index changed status, using the first RFC 3339 timestamp in each
+// check's output. Checks are not considered on the first query of a service,
+// when index is zero.
+func checkChangeTime(checks api.HealthChecks, index uint64) time.Time {
+	var earliest time.Time
+	if index == 0 {
+		return earliest
+	}
+
+	for _, check := range checks {
+		if check.ModifyIndex <= index {
+			continue
+		}
+
+		ts := checkTimestamp.FindString(check.Output)
+		if ts == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			continue
+		}
+
+		if earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+	}
+
+	return earliest
+}
+
+// Status returns the current state of the connection to Consul. The number of
+// consecutive errors is tracked by the backoff counter, which is reset after
+// every successful query.
+func (c *ConsulFetcher) Status() FetcherStatus {
+	var last time.Time
+	if n := atomic.LoadInt64(&c.lastSuccess); n != 0 {
+		last = time.Unix(0, n)
+	}
+
+	var advanced time.Time
+	if n := atomic.LoadInt64(&c.indexAdvanced); n != 0 {
+		advanced = time.Unix(0, n)
+	}
+
+	delay := atomic.LoadUint64(&c.delay)
+
+	return FetcherStatus{
+		LastSuccess:       last,
+		ConsecutiveErrors: delay,
+		Backoff:           backoffDuration(delay),
+		IndexAdvanced:     advanced,
+	}
+}
+
+// setIndex records the index returned by a health query as the index to
+// wait on, and the time the index last advanced
+func (c *ConsulFetcher) setIndex(service string, index uint64) {
+	if index != c.wait || atomic.LoadInt64(&c.indexAdvanced) == 0 {
+		atomic.StoreInt64(&c.indexAdvanced, time.Now().UnixNano())
+	}
+
+	c.wait = index
+	consulIndex.WithLabelValues(service).Set(float64(index))
 }
 
 func (m *Monitor) monitorService(service string, notify chan<- *RecordEntry) {
-	addressesCh := make(chan []string)
-	fetcher, _ := m.Fetcher(service)
+	resultCh := make(chan *FetchResult)
+	logger := m.logger.With("service", service)
+
+	fetcher, err := m.Fetcher(service, logger)
+	if err != nil {
+		logger.Error("Failed to create fetcher", "error", err)
+		return
+	}
+
+	m.mu.Lock()
+	m.fetchers[service] = fetcher
+	m.mu.Unlock()
 
 	for {
+		ctx, span := tracer().Start(context.Background(), spanFetch, trace.WithAttributes(
+			attribute.String("service", service),
+		))
 		go func() {
-			addressesCh <- fetcher.Fetch(service)
+			resultCh <- fetcher.Fetch(ctx, service)
 		}()
 
 		select {
 		case <-m.shutdownCh:
+			span.End()
 			return
-		case addresses := <-addressesCh:
+		case res := <-resultCh:
+			span.SetAttributes(attribute.Int("healthy", len(res.Addresses)))
+			span.End()
+
+			_, nspan := tracer().Start(ctx, spanNotify)
 			notify <- &RecordEntry{
-				addresses: addresses,
-				service:   service,
+				addresses:    res.Addresses,
+				service:      service,
+				changed:      res.Changed,
+				checkChanged: res.CheckChanged,
+				reason:       res.Reason,
+				regions:      res.Regions,
+				ordered:      res.Ordered,
+				spanContext:  nspan.SpanContext(),
 			}
+			nspan.End()
 		}
 	}
 }
@@ -149,8 +418,41 @@ func (m *Monitor) Run(notify chan<- *RecordEntry) error {
 	return nil
 }
 
+// Status returns the connectivity state of the Fetcher for each monitored
+// service whose Fetcher implements StatusReporter. Services monitored for a
+// View are keyed <service>@<view>.
+func (m *Monitor) Status() map[string]FetcherStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := make(map[string]FetcherStatus)
+	for service, fetcher := range m.fetchers {
+		if m.view != "" {
+			service += "@" + m.view
+		}
+
+		if r, ok := fetcher.(StatusReporter); ok {
+			status[service] = r.Status()
+		}
+	}
+
+	return status
+}
+
 // Shutdown ends monitoring activity
 func (m *Monitor) Shutdown(ctx context.Context) error {
 	close(m.shutdownCh)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, fetcher := range m.fetchers {
+		if s, ok := fetcher.(fetcherShutdown); ok {
+			if err := s.Shutdown(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
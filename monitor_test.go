@@ -1,20 +1,27 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
 
 type MockFetcher struct{}
 
-func NewMockFetcher(service string) (Fetcher, error) {
+func NewMockFetcher(service string, logger hclog.Logger) (Fetcher, error) {
 	return &MockFetcher{}, nil
 }
 
-func (m *MockFetcher) Fetch(service string) []string {
-	return []string{}
+func (m *MockFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	return &FetchResult{}
 }
 
 func TestMonitor_Run(t *testing.T) {
 	type fields struct {
-		Fetcher    func(string) (Fetcher, error)
+		Fetcher    func(string, hclog.Logger) (Fetcher, error)
 		services   []string
 		shutdownCh chan struct{}
 	}
@@ -62,3 +69,110 @@ func TestMonitor_Run(t *testing.T) {
 		})
 	}
 }
+
+func Test_checkChangeTime(t *testing.T) {
+	ts := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		checks api.HealthChecks
+		index  uint64
+		want   time.Time
+	}{
+		{
+			"first query",
+			api.HealthChecks{
+				{ModifyIndex: 10, Output: "failed at 2020-05-01T12:00:00Z"},
+			},
+			0,
+			time.Time{},
+		},
+		{
+			"unmodified check",
+			api.HealthChecks{
+				{ModifyIndex: 5, Output: "failed at 2020-05-01T12:00:00Z"},
+			},
+			5,
+			time.Time{},
+		},
+		{
+			"no timestamp",
+			api.HealthChecks{
+				{ModifyIndex: 10, Output: "connection refused"},
+			},
+			5,
+			time.Time{},
+		},
+		{
+			"modified check",
+			api.HealthChecks{
+				{ModifyIndex: 10, Output: "failed at 2020-05-01T12:00:00Z: connection refused"},
+			},
+			5,
+			ts,
+		},
+		{
+			"earliest of several checks",
+			api.HealthChecks{
+				{ModifyIndex: 10, Output: "2020-05-01T14:00:00+02:00 critical"},
+				{ModifyIndex: 10, Output: "2020-05-01T12:00:01.5Z critical"},
+				{ModifyIndex: 4, Output: "2020-05-01T11:00:00Z passing"},
+			},
+			5,
+			ts,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkChangeTime(tt.checks, tt.index); !got.Equal(tt.want) {
+				t.Errorf("checkChangeTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_entryAddress(t *testing.T) {
+	entry := &api.ServiceEntry{
+		Node: &api.Node{
+			Address:         "10.0.0.1",
+			TaggedAddresses: map[string]string{"lan": "10.0.0.1", "wan": "198.51.100.1"},
+		},
+		Service: &api.AgentService{
+			TaggedAddresses: map[string]api.ServiceAddress{"wan_ipv4": {Address: "203.0.113.1"}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		tag  string
+		want string
+	}{
+		{
+			"node address",
+			"",
+			"10.0.0.1",
+		},
+		{
+			"service tagged address",
+			"wan_ipv4",
+			"203.0.113.1",
+		},
+		{
+			"node tagged address",
+			"wan",
+			"198.51.100.1",
+		},
+		{
+			"unknown tag",
+			"other",
+			"10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entryAddress(entry, tt.tag); got != tt.want {
+				t.Errorf("entryAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/serf/coordinate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// nearestRefreshInterval bounds how long the service's health is watched
+// before network coordinates are refreshed
+const nearestRefreshInterval = time.Second * 30
+
+// NearestFetcher implements Fetcher to retrieve the addresses of the
+// healthy instances of a service, ordered by their distance from a reference
+// node as estimated by Consul's network coordinates. The selected instance
+// is ordered first until it becomes unhealthy, or another instance is closer
+// by more than a threshold. Returning every instance, rather than only the
+// selected one, lets a ProbeFetcher move selection to the next nearest
+// instance when the selected one fails its probe.
+type NearestFetcher struct {
+	*ConsulFetcher
+
+	node      string
+	threshold time.Duration
+
+	selected string
+	fetched  bool
+	last     []string
+}
+
+// nearestCandidate is a healthy instance and its estimated distance from
+// the reference node. Instances without a compatible coordinate have no
+// distance.
+type nearestCandidate struct {
+	address  string
+	distance time.Duration
+	known    bool
+}
+
+// NewNearestFetcher creates a NearestFetcher for a given service. If node is
+// empty, distances are measured from the node of the local Consul agent.
+func NewNearestFetcher(service, node string, threshold time.Duration, options ConsulOptions, logger hclog.Logger) (Fetcher, error) {
+	c, err := newConsulFetcher(service, options, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NearestFetcher{
+		ConsulFetcher: c,
+		node:          node,
+		threshold:     threshold,
+	}, nil
+}
+
+// Fetch watches the service's health, refreshing network coordinates at
+// least every nearestRefreshInterval, and returns the ordered addresses of
+// the healthy instances. The first call returns immediately; subsequent
+// calls return when the addresses or their order change. The returned
+// addresses are empty if the service has no healthy instances.
+func (n *NearestFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	for {
+		_, span := tracer().Start(ctx, spanConsul, trace.WithAttributes(
+			attribute.String("service", service),
+			attribute.Int64("consul.wait_index", int64(n.wait)),
+		))
+
+		candidates, err := n.candidates(ctx, service)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+
+			n.logger.Error("Failed to fetch nearest instance", "error", err)
+			consulMonitorError.WithLabelValues(service).Inc()
+			fetchError.WithLabelValues(service, backendConsul).Inc()
+
+			_, bspan := tracer().Start(ctx, spanBackoff, trace.WithAttributes(
+				attribute.Int64("backoff.attempt", int64(atomic.LoadUint64(&n.delay)+1)),
+			))
+			n.backoff(&n.delay)
+			bspan.End()
+			continue
+		}
+		n.reset(&n.delay)
+		atomic.StoreInt64(&n.lastSuccess, time.Now().UnixNano())
+
+		addresses, nearer := orderNearest(n.selected, candidates, n.threshold)
+		selected := ""
+		if len(addresses) > 0 {
+			selected = addresses[0]
+		}
+		span.SetAttributes(
+			attribute.Int64("consul.index", int64(n.wait)),
+			attribute.Int("healthy", len(candidates)),
+			attribute.String("nearest", selected),
+		)
+		span.End()
+
+		if n.fetched && reflect.DeepEqual(addresses, n.last) {
+			continue
+		}
+		n.fetched = true
+		n.selected = selected
+		n.last = addresses
+
+		res := &FetchResult{
+			Addresses: addresses,
+			Changed:   time.Now(),
+			Ordered:   true,
+		}
+		if nearer {
+			n.logger.Info("Selecting nearer instance", "address", selected)
+			res.Reason = ReasonNearer
+		}
+
+		return res
+	}
+}
+
+// candidates waits for a change to the service's health, or for the refresh
+// interval to pass, and returns the healthy instances with their distances
+// from the reference node
+func (n *NearestFetcher) candidates(ctx context.Context, service string) ([]nearestCandidate, error) {
+	q := &api.QueryOptions{
+		Datacenter: n.options.Datacenter,
+		WaitIndex:  n.wait,
+		WaitTime:   nearestRefreshInterval,
+	}
+	entries, meta, err := n.client.Health().Service(service, "", true, q.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	n.setIndex(service, meta.LastIndex)
+	consulLastContact.WithLabelValues(service).Set(meta.LastContact.Seconds())
+
+	node := n.node
+	if node == "" {
+		if node, err = n.client.Agent().NodeName(); err != nil {
+			return nil, err
+		}
+	}
+
+	coords, _, err := n.client.Coordinate().Nodes((&api.QueryOptions{
+		Datacenter: n.options.Datacenter,
+	}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return nearestCandidates(node, entries, coords, n.options.TaggedAddress), nil
+}
+
+// nearestCandidates returns the unique addresses of a set of service
+// entries, using the tagged address tag if set, with their distances from a
+// reference node where both have compatible coordinates
+func nearestCandidates(node string, entries []*api.ServiceEntry, coords []*api.CoordinateEntry, tag string) []nearestCandidate {
+	byNode := make(map[string]*coordinate.Coordinate)
+	for _, c := range coords {
+		// prefer the default network segment
+		if _, ok := byNode[c.Node]; !ok || c.Segment == "" {
+			byNode[c.Node] = c.Coord
+		}
+	}
+	ref := byNode[node]
+
+	seen := make(map[string]bool)
+	var candidates []nearestCandidate
+	for _, e := range entries {
+		address := entryAddress(e, tag)
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		c := nearestCandidate{address: address}
+		if coord := byNode[e.Node.Node]; ref != nil && coord != nil && ref.IsCompatibleWith(coord) {
+			c.distance = ref.DistanceTo(coord)
+			c.known = true
+		}
+		candidates = append(candidates, c)
+	}
+
+	return candidates
+}
+
+// orderNearest returns the addresses of a set of candidates in order of
+// preference. The current address is first while it is a candidate, unless
+// another candidate is closer by more than threshold, in which case nearer
+// is true. Other candidates are ordered by distance, those without a
+// distance after those with one, and ties are broken by the lowest address.
+func orderNearest(current string, candidates []nearestCandidate, threshold time.Duration) (addresses []string, nearer bool) {
+	addresses = []string{}
+	if len(candidates) == 0 {
+		return addresses, false
+	}
+
+	sorted := append([]nearestCandidate(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.known != b.known {
+			return a.known
+		}
+		if a.distance != b.distance {
+			return a.distance < b.distance
+		}
+		return a.address < b.address
+	})
+	for _, c := range sorted {
+		addresses = append(addresses, c.address)
+	}
+	nearest := sorted[0]
+
+	for i, c := range sorted {
+		if c.address != current {
+			continue
+		}
+
+		if nearest.known && (!c.known || c.distance-nearest.distance > threshold) {
+			return addresses, true
+		}
+
+		// keep the current address first
+		copy(addresses[1:i+1], addresses[:i])
+		addresses[0] = current
+		return addresses, false
+	}
+
+	return addresses, false
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/serf/coordinate"
+)
+
+func testCoordinate(x float64) *coordinate.Coordinate {
+	c := coordinate.NewCoordinate(coordinate.DefaultConfig())
+	c.Vec[0] = x
+	return c
+}
+
+func Test_nearestCandidates(t *testing.T) {
+	entries := []*api.ServiceEntry{
+		{Node: &api.Node{Node: "a", Address: "10.0.0.1"}},
+		{Node: &api.Node{Node: "b", Address: "10.0.0.2"}},
+		{Node: &api.Node{Node: "b", Address: "10.0.0.2"}},
+		{Node: &api.Node{Node: "c", Address: "10.0.0.3"}},
+	}
+	coords := []*api.CoordinateEntry{
+		{Node: "ref", Coord: testCoordinate(0)},
+		{Node: "a", Coord: testCoordinate(0.02)},
+		{Node: "b", Segment: "other", Coord: testCoordinate(0.5)},
+		{Node: "b", Coord: testCoordinate(0.01)},
+	}
+
+	tests := []struct {
+		name string
+		node string
+		want []nearestCandidate
+	}{
+		{
+			"distances from reference node",
+			"ref",
+			[]nearestCandidate{
+				{"10.0.0.1", time.Millisecond * 20, true},
+				{"10.0.0.2", time.Millisecond * 10, true},
+				{"10.0.0.3", 0, false},
+			},
+		},
+		{
+			"reference node without coordinate",
+			"unknown",
+			[]nearestCandidate{
+				{"10.0.0.1", 0, false},
+				{"10.0.0.2", 0, false},
+				{"10.0.0.3", 0, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nearestCandidates(tt.node, entries, coords, "")
+			for i := range got {
+				// allow for the rounding of coordinate distances
+				got[i].distance = got[i].distance.Round(time.Millisecond)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nearestCandidates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_orderNearest(t *testing.T) {
+	candidates := []nearestCandidate{
+		{"10.0.0.3", 0, false},
+		{"10.0.0.2", time.Millisecond * 8, true},
+		{"10.0.0.1", time.Millisecond * 20, true},
+	}
+
+	tests := []struct {
+		name       string
+		current    string
+		candidates []nearestCandidate
+		threshold  time.Duration
+		want       []string
+		wantNearer bool
+	}{
+		{
+			"no candidates",
+			"10.0.0.1",
+			nil,
+			time.Millisecond * 5,
+			[]string{},
+			false,
+		},
+		{
+			"initial selection is nearest",
+			"",
+			candidates,
+			time.Millisecond * 5,
+			[]string{"10.0.0.2", "10.0.0.1", "10.0.0.3"},
+			false,
+		},
+		{
+			"current unhealthy",
+			"10.0.0.9",
+			candidates,
+			time.Millisecond * 5,
+			[]string{"10.0.0.2", "10.0.0.1", "10.0.0.3"},
+			false,
+		},
+		{
+			"current kept within threshold",
+			"10.0.0.1",
+			candidates,
+			time.Millisecond * 15,
+			[]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			false,
+		},
+		{
+			"nearer past threshold",
+			"10.0.0.1",
+			candidates,
+			time.Millisecond * 5,
+			[]string{"10.0.0.2", "10.0.0.1", "10.0.0.3"},
+			true,
+		},
+		{
+			"current without distance",
+			"10.0.0.3",
+			candidates,
+			time.Millisecond * 5,
+			[]string{"10.0.0.2", "10.0.0.1", "10.0.0.3"},
+			true,
+		},
+		{
+			"lowest address without distances",
+			"",
+			[]nearestCandidate{{"10.0.0.2", 0, false}, {"10.0.0.1", 0, false}},
+			time.Millisecond * 5,
+			[]string{"10.0.0.1", "10.0.0.2"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, nearer := orderNearest(tt.current, tt.candidates, tt.threshold)
+			if !reflect.DeepEqual(got, tt.want) || nearer != tt.wantNearer {
+				t.Errorf("orderNearest() = %v, %v, want %v, %v", got, nearer, tt.want, tt.wantNearer)
+			}
+		})
+	}
+}
+
+func Test_dnsHandler_update_nearer(t *testing.T) {
+	l := &MockListener{}
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.AddListener(l)
+
+	h.update(context.Background(), "bar", []string{"127.0.0.1"}, "", false)
+	h.update(context.Background(), "bar", []string{"127.0.0.2"}, ReasonNearer, false)
+
+	want := []ChangeReason{ReasonInitial, ReasonNearer}
+	if len(l.changes) != len(want) {
+		t.Fatalf("update() produced %d changes, want %d", len(l.changes), len(want))
+	}
+	for i, c := range l.changes {
+		if c.Reason != want[i] {
+			t.Errorf("update() change %d reason = %v, want %v", i, c.Reason, want[i])
+		}
+	}
+}
+
+func Test_dnsHandler_update_ordered(t *testing.T) {
+	l := &MockListener{}
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.AddListener(l)
+
+	update := func(records ...string) {
+		h.update(context.Background(), "bar", records, "", true)
+	}
+
+	update("127.0.0.2", "127.0.0.1")
+	if got := h.Selected("bar"); got != "127.0.0.2" {
+		t.Errorf("Selected() = %v, want the first record", got)
+	}
+
+	// the nearest record fails its probe, so the next nearest is served
+	update("127.0.0.1")
+	if got := h.Selected("bar"); got != "127.0.0.1" {
+		t.Errorf("Selected() = %v, want the next nearest record", got)
+	}
+
+	update("127.0.0.2", "127.0.0.1")
+	if got := h.Selected("bar"); got != "127.0.0.2" {
+		t.Errorf("Selected() = %v, want the nearest record once it recovers", got)
+	}
+
+	// a preferred record is served while the current record is healthy
+	update("127.0.0.3", "127.0.0.2", "127.0.0.1")
+	if got := h.Selected("bar"); got != "127.0.0.3" {
+		t.Errorf("Selected() = %v, want the preferred record", got)
+	}
+
+	want := []ChangeReason{ReasonInitial, ReasonUnhealthy, ReasonFailback, ReasonNearer}
+	if len(l.changes) != len(want) {
+		t.Fatalf("update() produced %d changes, want %d", len(l.changes), len(want))
+	}
+	for i, c := range l.changes {
+		if c.Reason != want[i] {
+			t.Errorf("update() change %d reason = %v, want %v", i, c.Reason, want[i])
+		}
+	}
+}
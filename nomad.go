@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// NomadFetcher implements Fetcher to retrieve a list of addresses for a given
+// service registered with Nomad's native service discovery. Registrations
+// are healthy if their allocation is running.
+type NomadFetcher struct {
+	service string
+	client  *nomad.Client
+
+	wait     uint64
+	waitTime time.Duration
+
+	fetched bool
+	last    []string
+
+	lastSuccess int64
+	delay       uint64
+
+	backoff func(*uint64)
+	reset   func(*uint64)
+
+	logger hclog.Logger
+}
+
+// NewNomadFetcher creates a NomadFetcher for a given service. Unset config
+// values are read from the Nomad SDK's environment variables, such as
+// NOMAD_ADDR and NOMAD_TOKEN.
+func NewNomadFetcher(service string, config NomadConfig, logger hclog.Logger) (Fetcher, error) {
+	c := nomad.DefaultConfig()
+	if config.Address != "" {
+		c.Address = config.Address
+	}
+	if config.Namespace != "" {
+		c.Namespace = config.Namespace
+	}
+	if config.Region != "" {
+		c.Region = config.Region
+	}
+	if config.Token != "" {
+		c.SecretID = config.Token
+	}
+
+	client, err := nomad.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff, reset := backoffFuncs()
+
+	return &NomadFetcher{
+		service:  service,
+		client:   client,
+		waitTime: config.WaitTime,
+		backoff:  backoff,
+		reset:    reset,
+		logger:   logger.With("namespace", c.Namespace),
+	}, nil
+}
+
+// Fetch retrieves the addresses of the service's healthy registrations. It
+// uses blocking queries to act on registration changes, bounded by the wait
+// time so that changes to allocation status are seen. The first call returns
+// immediately; subsequent calls return when the healthy addresses change.
+func (n *NomadFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	for {
+		regs, meta, err := n.client.Services().Get(service, (&nomad.QueryOptions{
+			WaitIndex: n.wait,
+			WaitTime:  n.waitTime,
+		}).WithContext(ctx))
+
+		var addresses []string
+		if err == nil {
+			addresses, err = n.healthy(ctx, regs)
+		}
+		if err != nil {
+			n.logger.Error("Failed to fetch service registrations", "error", err)
+			fetchError.WithLabelValues(service, backendNomad).Inc()
+			n.backoff(&n.delay)
+			continue
+		}
+		// the index is only advanced once the registrations' allocations
+		// are read, so that a failed read is retried without blocking
+		n.wait = meta.LastIndex
+		n.reset(&n.delay)
+		atomic.StoreInt64(&n.lastSuccess, time.Now().UnixNano())
+
+		if !n.fetched || !reflect.DeepEqual(addresses, n.last) {
+			n.fetched = true
+			n.last = addresses
+			return &FetchResult{
+				Addresses: addresses,
+				Changed:   time.Now(),
+			}
+		}
+	}
+}
+
+// healthy returns the sorted, unique addresses of registrations whose
+// allocation is healthy. Registrations of allocations that no longer exist
+// are not healthy.
+func (n *NomadFetcher) healthy(ctx context.Context, regs []*nomad.ServiceRegistration) ([]string, error) {
+	seen := make(map[string]bool)
+	addresses := []string{}
+
+	// the health of each allocation, as several registrations may share one
+	allocs := make(map[string]bool)
+
+	for _, r := range regs {
+		if seen[r.Address] {
+			continue
+		}
+
+		healthy, ok := allocs[r.AllocID]
+		if !ok {
+			alloc, _, err := n.client.Allocations().Info(r.AllocID, (&nomad.QueryOptions{}).WithContext(ctx))
+			var uerr nomad.UnexpectedResponseError
+			switch {
+			case errors.As(err, &uerr) && uerr.StatusCode() == http.StatusNotFound:
+				// the allocation was garbage collected
+			case err != nil:
+				return nil, err
+			default:
+				healthy = allocHealthy(alloc)
+			}
+			allocs[r.AllocID] = healthy
+		}
+
+		if healthy {
+			seen[r.Address] = true
+			addresses = append(addresses, r.Address)
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses, nil
+}
+
+// allocHealthy returns true if an allocation is running, and has not been
+// marked unhealthy by a deployment
+func allocHealthy(a *nomad.Allocation) bool {
+	if a.DesiredStatus != nomad.AllocDesiredStatusRun || a.ClientStatus != nomad.AllocClientStatusRunning {
+		return false
+	}
+
+	if a.DeploymentStatus != nil && a.DeploymentStatus.Healthy != nil {
+		return *a.DeploymentStatus.Healthy
+	}
+
+	return true
+}
+
+// Status returns the current state of the connection to Nomad
+func (n *NomadFetcher) Status() FetcherStatus {
+	var last time.Time
+	if t := atomic.LoadInt64(&n.lastSuccess); t != 0 {
+		last = time.Unix(0, t)
+	}
+
+	delay := atomic.LoadUint64(&n.delay)
+
+	return FetcherStatus{
+		LastSuccess:       last,
+		ConsecutiveErrors: delay,
+		Backoff:           backoffDuration(delay),
+	}
+}
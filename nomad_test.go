@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+func Test_allocHealthy(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		name  string
+		alloc *nomad.Allocation
+		want  bool
+	}{
+		{
+			"running",
+			&nomad.Allocation{DesiredStatus: "run", ClientStatus: "running"},
+			true,
+		},
+		{
+			"pending",
+			&nomad.Allocation{DesiredStatus: "run", ClientStatus: "pending"},
+			false,
+		},
+		{
+			"stopping",
+			&nomad.Allocation{DesiredStatus: "stop", ClientStatus: "running"},
+			false,
+		},
+		{
+			"healthy deployment",
+			&nomad.Allocation{DesiredStatus: "run", ClientStatus: "running", DeploymentStatus: &nomad.AllocDeploymentStatus{Healthy: &yes}},
+			true,
+		},
+		{
+			"unhealthy deployment",
+			&nomad.Allocation{DesiredStatus: "run", ClientStatus: "running", DeploymentStatus: &nomad.AllocDeploymentStatus{Healthy: &no}},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allocHealthy(tt.alloc); got != tt.want {
+				t.Errorf("allocHealthy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// MockNomad serves the Nomad service and allocation endpoints. Blocking
+// queries return once the index advances, or after block (default a
+// second). If failures is positive, that many allocation reads fail.
+type MockNomad struct {
+	mu       sync.Mutex
+	index    uint64
+	block    time.Duration
+	changed  chan struct{}
+	services []*nomad.ServiceRegistration
+	allocs   map[string]*nomad.Allocation
+	failures int
+}
+
+func (m *MockNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/service/"):
+		wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+		m.mu.Lock()
+		changed := m.changed
+		index := m.index
+		block := m.block
+		m.mu.Unlock()
+
+		if block == 0 {
+			block = time.Second
+		}
+		if wait >= index {
+			select {
+			case <-changed:
+			case <-time.After(block):
+			}
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		w.Header().Set("X-Nomad-Index", strconv.FormatUint(m.index, 10))
+		json.NewEncoder(w).Encode(m.services)
+	case strings.HasPrefix(r.URL.Path, "/v1/allocation/"):
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.failures > 0 {
+			m.failures--
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		alloc, ok := m.allocs[strings.TrimPrefix(r.URL.Path, "/v1/allocation/")]
+		if !ok {
+			http.Error(w, "alloc not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Nomad-Index", strconv.FormatUint(m.index, 10))
+		json.NewEncoder(w).Encode(alloc)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockNomad) setStatus(alloc, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.allocs[alloc].ClientStatus = status
+	m.index++
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func TestNomadFetcher_Fetch(t *testing.T) {
+	m := &MockNomad{
+		index:   1,
+		changed: make(chan struct{}),
+		services: []*nomad.ServiceRegistration{
+			{ServiceName: "web", AllocID: "a1", Address: "10.0.0.1"},
+			{ServiceName: "web", AllocID: "a2", Address: "10.0.0.2"},
+			// a garbage collected allocation
+			{ServiceName: "web", AllocID: "a3", Address: "10.0.0.3"},
+		},
+		allocs: map[string]*nomad.Allocation{
+			"a1": {ID: "a1", DesiredStatus: "run", ClientStatus: "running"},
+			"a2": {ID: "a2", DesiredStatus: "run", ClientStatus: "pending"},
+		},
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	f, err := NewNomadFetcher("web", NomadConfig{Address: srv.URL, WaitTime: time.Second}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewNomadFetcher() error = %v", err)
+	}
+
+	ctx := context.Background()
+	if got := f.Fetch(ctx, "web").Addresses; !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("Fetch() = %v, want running allocations", got)
+	}
+
+	resultCh := make(chan *FetchResult, 1)
+	go func() {
+		resultCh <- f.Fetch(ctx, "web")
+	}()
+
+	m.setStatus("a2", "running")
+
+	select {
+	case res := <-resultCh:
+		if !reflect.DeepEqual(res.Addresses, []string{"10.0.0.1", "10.0.0.2"}) {
+			t.Errorf("Fetch() = %v, want changed addresses", res.Addresses)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Fetch() did not return for a changed allocation")
+	}
+}
+
+func TestNomadFetcher_Fetch_allocError(t *testing.T) {
+	m := &MockNomad{
+		index:   1,
+		block:   time.Second * 30,
+		changed: make(chan struct{}),
+		services: []*nomad.ServiceRegistration{
+			{ServiceName: "web", AllocID: "a1", Address: "10.0.0.1"},
+		},
+		allocs: map[string]*nomad.Allocation{
+			"a1": {ID: "a1", DesiredStatus: "run", ClientStatus: "running"},
+		},
+		failures: 1,
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	f, err := NewNomadFetcher("web", NomadConfig{Address: srv.URL, WaitTime: time.Second * 30}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewNomadFetcher() error = %v", err)
+	}
+
+	// the failed allocation read is retried without waiting for the index
+	// to advance
+	resultCh := make(chan *FetchResult, 1)
+	go func() {
+		resultCh <- f.Fetch(context.Background(), "web")
+	}()
+
+	select {
+	case res := <-resultCh:
+		if !reflect.DeepEqual(res.Addresses, []string{"10.0.0.1"}) {
+			t.Errorf("Fetch() = %v, want running allocations", res.Addresses)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("Fetch() did not retry after a failed allocation read")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// HTTPFetcher implements Fetcher to retrieve a list of addresses for a given
+// service by polling an HTTP endpoint that returns JSON. Addresses are
+// extracted from the response with a JSONPath expression.
+type HTTPFetcher struct {
+	url    string
+	path   jsonPath
+	config HTTPBackendConfig
+	client *http.Client
+
+	etag    string
+	fetched bool
+	last    []string
+
+	lastSuccess int64
+	delay       uint64
+
+	backoff func(*uint64)
+	reset   func(*uint64)
+
+	logger hclog.Logger
+}
+
+// NewHTTPFetcher creates an HTTPFetcher polling a given URL
+func NewHTTPFetcher(url string, config HTTPBackendConfig, logger hclog.Logger) (Fetcher, error) {
+	path, err := compileJSONPath(config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff, reset := backoffFuncs()
+
+	return &HTTPFetcher{
+		url:     url,
+		path:    path,
+		config:  config,
+		client:  &http.Client{Timeout: config.Timeout},
+		backoff: backoff,
+		reset:   reset,
+		logger:  logger.With("url", url),
+	}, nil
+}
+
+// Fetch polls the URL every interval, and returns the addresses in the
+// response. The first call returns immediately; subsequent calls return when
+// the addresses change.
+func (f *HTTPFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	for {
+		if f.fetched {
+			time.Sleep(f.config.Interval)
+		}
+
+		addresses, err := f.poll(ctx)
+		if err != nil {
+			f.logger.Error("Failed to poll service addresses", "error", err)
+			fetchError.WithLabelValues(service, backendHTTP).Inc()
+			f.backoff(&f.delay)
+			continue
+		}
+		f.reset(&f.delay)
+		atomic.StoreInt64(&f.lastSuccess, time.Now().UnixNano())
+
+		// the response was not modified
+		if addresses == nil {
+			continue
+		}
+
+		if !f.fetched || !reflect.DeepEqual(addresses, f.last) {
+			f.fetched = true
+			f.last = addresses
+			return &FetchResult{
+				Addresses: addresses,
+				Changed:   time.Now(),
+			}
+		}
+	}
+}
+
+// poll requests the URL, and returns the sorted, unique addresses in the
+// response. If ETags are enabled and the response was not modified, poll
+// returns nil addresses.
+func (f *HTTPFetcher) poll(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	if f.config.AuthHeader != "" {
+		req.Header.Set("Authorization", f.config.AuthHeader)
+	}
+	if f.config.ETag && f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && f.config.ETag {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var body interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	addresses, err := jsonAddresses(f.path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.config.ETag {
+		f.etag = resp.Header.Get("ETag")
+	}
+
+	return addresses, nil
+}
+
+// jsonAddresses returns the sorted, unique IPv4 addresses matched by a
+// jsonPath. Every matched value must be an IPv4 address.
+func jsonAddresses(path jsonPath, body interface{}) ([]string, error) {
+	seen := make(map[string]bool)
+	addresses := []string{}
+
+	for _, v := range path.eval(body) {
+		s, ok := v.(string)
+		if !ok || net.ParseIP(s).To4() == nil {
+			return nil, fmt.Errorf("matched value %v is not an IPv4 address", v)
+		}
+
+		if !seen[s] {
+			seen[s] = true
+			addresses = append(addresses, s)
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses, nil
+}
+
+// httpBackendURL returns the URL polled for a service, replacing {service}
+// in a URL template with the service name
+func httpBackendURL(template, service string) string {
+	return strings.Replace(template, "{service}", service, -1)
+}
+
+// Status returns the current state of polling the URL
+func (f *HTTPFetcher) Status() FetcherStatus {
+	var last time.Time
+	if n := atomic.LoadInt64(&f.lastSuccess); n != 0 {
+		last = time.Unix(0, n)
+	}
+
+	delay := atomic.LoadUint64(&f.delay)
+
+	return FetcherStatus{
+		LastSuccess:       last,
+		ConsecutiveErrors: delay,
+		Backoff:           backoffDuration(delay),
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestHTTPFetcher_Fetch(t *testing.T) {
+	var mu sync.Mutex
+	version := 1
+	body := `{"hosts": [{"address": "10.0.0.2"}, {"address": "10.0.0.1"}]}`
+	var notModified int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path != "/hosts/web" || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%d"`, version)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	config := HTTPBackendConfig{
+		Path:       "$.hosts[*].address",
+		Interval:   time.Millisecond * 10,
+		Timeout:    time.Second,
+		AuthHeader: "Bearer token",
+		ETag:       true,
+	}
+	f, err := NewHTTPFetcher(httpBackendURL(srv.URL+"/hosts/{service}", "web"), config, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewHTTPFetcher() error = %v", err)
+	}
+
+	ctx := context.Background()
+	if got := f.Fetch(ctx, "web").Addresses; !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Fetch() = %v, want initial addresses", got)
+	}
+
+	resultCh := make(chan *FetchResult, 1)
+	go func() {
+		resultCh <- f.Fetch(ctx, "web")
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	mu.Lock()
+	version++
+	body = `{"hosts": [{"address": "10.0.0.2"}]}`
+	mu.Unlock()
+
+	select {
+	case res := <-resultCh:
+		if !reflect.DeepEqual(res.Addresses, []string{"10.0.0.2"}) {
+			t.Errorf("Fetch() = %v, want changed addresses", res.Addresses)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Fetch() did not return for a changed response")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if notModified == 0 {
+		t.Errorf("Fetch() did not send If-None-Match with the last ETag")
+	}
+}
+
+func Test_jsonAddresses(t *testing.T) {
+	p, _ := compileJSONPath("$[*]")
+
+	tests := []struct {
+		name    string
+		body    []interface{}
+		want    []string
+		wantErr bool
+	}{
+		{
+			"addresses",
+			[]interface{}{"10.0.0.2", "10.0.0.1", "10.0.0.2"},
+			[]string{"10.0.0.1", "10.0.0.2"},
+			false,
+		},
+		{
+			"no addresses",
+			[]interface{}{},
+			[]string{},
+			false,
+		},
+		{
+			"hostname",
+			[]interface{}{"web1"},
+			nil,
+			true,
+		},
+		{
+			"number",
+			[]interface{}{float64(1)},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsonAddresses(p, interface{}(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jsonAddresses() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jsonAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Probe types run by a ProbeFetcher
+const (
+	probeTCP  = "tcp"
+	probeHTTP = "http"
+	probeDNS  = "dns"
+	probeTLS  = "tls"
+)
+
+// probeFunc checks the health of an address, returning an error if it is
+// not healthy
+type probeFunc func(ctx context.Context, address string) error
+
+// newProbe returns a probeFunc for a given configuration
+func newProbe(config ProbeConfig) (probeFunc, error) {
+	port := strconv.Itoa(config.Port)
+
+	switch config.Type {
+	case probeTCP:
+		return func(ctx context.Context, address string) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(address, port))
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}, nil
+	case probeHTTP:
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		return func(ctx context.Context, address string) error {
+			url := fmt.Sprintf("%s://%s%s", config.Scheme, net.JoinHostPort(address, port), config.Path)
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				return err
+			}
+
+			resp, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != config.ExpectStatus {
+				return fmt.Errorf("unexpected status %s", resp.Status)
+			}
+			return nil
+		}, nil
+	case probeDNS:
+		return func(ctx context.Context, address string) error {
+			msg := &dns.Msg{}
+			msg.SetQuestion(dns.Fqdn(config.QueryName), dns.TypeA)
+
+			resp, _, err := (&dns.Client{}).ExchangeContext(ctx, msg, net.JoinHostPort(address, port))
+			if err != nil {
+				return err
+			}
+
+			if resp.Rcode != dns.RcodeSuccess {
+				return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[resp.Rcode])
+			}
+			return nil
+		}, nil
+	case probeTLS:
+		return func(ctx context.Context, address string) error {
+			d := &tls.Dialer{
+				Config: &tls.Config{
+					ServerName:         config.ServerName,
+					InsecureSkipVerify: config.InsecureSkipVerify,
+				},
+			}
+
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(address, port))
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown probe type %q", config.Type)
+}
+
+// prober probes a single address every interval, and tracks whether the
+// address is up using rise and fall thresholds. An address is up or down
+// after its first probe, and subsequently changes state after Rise
+// consecutive successes or Fall consecutive failures.
+type prober struct {
+	service string
+	address string
+	config  ProbeConfig
+	probe   probeFunc
+
+	mu        sync.RWMutex
+	probed    bool
+	up        bool
+	successes int
+	failures  int
+
+	changeCh   chan<- struct{}
+	stopCh     chan struct{}
+	shutdownCh <-chan struct{}
+
+	logger hclog.Logger
+}
+
+// run probes the address every interval until stopped, or its ProbeFetcher
+// is shut down. The first probe is
+// made by the caller, an interval before the first probe made by run.
+func (p *prober) run() {
+	t := time.NewTicker(p.config.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			probeUp.DeleteLabelValues(p.service, p.address)
+			return
+		case <-p.shutdownCh:
+			return
+		case <-t.C:
+		}
+
+		p.check()
+	}
+}
+
+func (p *prober) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+
+	timer := prometheus.NewTimer(probeDuration.WithLabelValues(p.service))
+	err := p.probe(ctx, p.address)
+	timer.ObserveDuration()
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	probeTotal.WithLabelValues(p.service, p.config.Type, result).Inc()
+
+	if p.record(err == nil) {
+		if err != nil {
+			p.logger.Warn("Probe marked address down", "address", p.address, "error", err)
+		} else {
+			p.logger.Info("Probe marked address up", "address", p.address)
+		}
+
+		select {
+		case p.changeCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// record applies the result of a probe, and returns true if the address
+// changed state
+func (p *prober) record(success bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if success {
+		p.successes++
+		p.failures = 0
+	} else {
+		p.failures++
+		p.successes = 0
+	}
+
+	was := p.probed && p.up
+
+	up := p.up
+	switch {
+	case !p.probed:
+		up = success
+		p.probed = true
+	case !p.up && p.successes >= p.config.Rise:
+		up = true
+	case p.up && p.failures >= p.config.Fall:
+		up = false
+	}
+
+	p.up = up
+
+	v := 0.0
+	if up {
+		v = 1
+	}
+	probeUp.WithLabelValues(p.service, p.address).Set(v)
+
+	return up != was
+}
+
+func (p *prober) isUp() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.probed && p.up
+}
+
+// ProbeFetcher implements Fetcher by wrapping another Fetcher, and returns
+// only the addresses that are both healthy in the wrapped Fetcher's backend
+// and up according to hobson's own probes
+type ProbeFetcher struct {
+	Fetcher
+
+	service string
+	config  ProbeConfig
+	probe   probeFunc
+
+	// ctx is cancelled on Shutdown, ending any fetch from the wrapped
+	// Fetcher. fetching is true while a fetch started by a call to Fetch
+	// has not yet returned its result on resultCh.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	fetching bool
+	resultCh chan *FetchResult
+	changeCh chan struct{}
+
+	shutdownCh chan struct{}
+	shutdown   sync.Once
+
+	backend []string
+	probers map[string]*prober
+
+	fetched bool
+	last    []string
+
+	logger hclog.Logger
+}
+
+// NewProbeFetcher creates a ProbeFetcher probing the addresses of a given
+// service fetched by a Fetcher
+func NewProbeFetcher(service string, fetcher Fetcher, config ProbeConfig, logger hclog.Logger) (Fetcher, error) {
+	probe, err := newProbe(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &ProbeFetcher{
+		Fetcher:    fetcher,
+		service:    service,
+		config:     config,
+		probe:      probe,
+		ctx:        ctx,
+		cancel:     cancel,
+		resultCh:   make(chan *FetchResult),
+		changeCh:   make(chan struct{}, 1),
+		shutdownCh: make(chan struct{}),
+		probers:    make(map[string]*prober),
+		logger:     logger.With("probe", config.Type),
+	}, nil
+}
+
+// Fetch returns when either the wrapped Fetcher's addresses change, or an
+// address changes probe state, and the addresses that are healthy and up
+// have changed. The wrapped Fetcher is called with the span in ctx, unless
+// a call made by an earlier Fetch is still waiting for a change. Fetch
+// returns an empty result once the ProbeFetcher is shut down.
+func (p *ProbeFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	res := &FetchResult{}
+	for {
+		if !p.fetching {
+			p.fetching = true
+			go p.fetch(trace.ContextWithSpan(p.ctx, trace.SpanFromContext(ctx)), service)
+		}
+
+		select {
+		case <-p.shutdownCh:
+			return res
+		case r := <-p.resultCh:
+			p.fetching = false
+			p.setBackend(r.Addresses)
+			res.Changed = r.Changed
+			res.CheckChanged = r.CheckChanged
+			res.Reason = r.Reason
+			res.Regions = r.Regions
+			res.Ordered = r.Ordered
+		case <-p.changeCh:
+			res.Changed = time.Now()
+		}
+
+		addresses := p.healthy()
+		if !p.fetched || !reflect.DeepEqual(addresses, p.last) {
+			p.fetched = true
+			p.last = addresses
+			res.Addresses = addresses
+			return res
+		}
+	}
+}
+
+// fetch fetches from the wrapped Fetcher, and passes the result to Fetch
+func (p *ProbeFetcher) fetch(ctx context.Context, service string) {
+	r := p.Fetcher.Fetch(ctx, service)
+
+	select {
+	case p.resultCh <- r:
+	case <-p.shutdownCh:
+	}
+}
+
+// Status returns the state of the wrapped Fetcher's connection to its
+// backend, or a zero FetcherStatus if it does not implement StatusReporter
+func (p *ProbeFetcher) Status() FetcherStatus {
+	if r, ok := p.Fetcher.(StatusReporter); ok {
+		return r.Status()
+	}
+
+	return FetcherStatus{}
+}
+
+// Shutdown stops probing, and ends any fetch from the wrapped Fetcher
+func (p *ProbeFetcher) Shutdown(ctx context.Context) error {
+	p.shutdown.Do(func() {
+		p.cancel()
+		close(p.shutdownCh)
+	})
+
+	return nil
+}
+
+// setBackend starts probing new addresses, and stops probing addresses that
+// are no longer healthy in the backend. New addresses are probed once before
+// setBackend returns, so that they are not omitted from the healthy
+// addresses until their first scheduled probe.
+func (p *ProbeFetcher) setBackend(addresses []string) {
+	p.backend = addresses
+
+	var added []*prober
+	current := make(map[string]bool)
+	for _, a := range addresses {
+		current[a] = true
+
+		if _, ok := p.probers[a]; !ok {
+			pr := &prober{
+				service:    p.service,
+				address:    a,
+				config:     p.config,
+				probe:      p.probe,
+				changeCh:   p.changeCh,
+				stopCh:     make(chan struct{}),
+				shutdownCh: p.shutdownCh,
+				logger:     p.logger,
+			}
+			p.probers[a] = pr
+			added = append(added, pr)
+		}
+	}
+
+	// each probe is bounded by the probe timeout
+	var wg sync.WaitGroup
+	for _, pr := range added {
+		wg.Add(1)
+		go func(pr *prober) {
+			defer wg.Done()
+			pr.check()
+		}(pr)
+	}
+	wg.Wait()
+
+	for _, pr := range added {
+		go pr.run()
+	}
+
+	for a, pr := range p.probers {
+		if !current[a] {
+			close(pr.stopCh)
+			delete(p.probers, a)
+		}
+	}
+}
+
+// healthy returns the backend's healthy addresses that are up, in the
+// backend's order
+func (p *ProbeFetcher) healthy() []string {
+	addresses := []string{}
+	for _, a := range p.backend {
+		if pr, ok := p.probers[a]; ok && pr.isUp() {
+			addresses = append(addresses, a)
+		}
+	}
+
+	return addresses
+}
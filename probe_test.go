@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func Test_prober_record(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []bool
+		want    []bool
+		wantUp  bool
+	}{
+		{
+			"first success is up",
+			[]bool{true},
+			[]bool{true},
+			true,
+		},
+		{
+			"first failure is down",
+			[]bool{false},
+			[]bool{false},
+			false,
+		},
+		{
+			"falls after fall failures",
+			[]bool{true, false, false, false},
+			[]bool{true, false, false, true},
+			false,
+		},
+		{
+			"success resets failures",
+			[]bool{true, false, false, true, false, false},
+			[]bool{true, false, false, false, false, false},
+			true,
+		},
+		{
+			"rises after rise successes",
+			[]bool{false, true, true},
+			[]bool{false, false, true},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &prober{
+				service: "foo",
+				address: "10.0.0.1",
+				config:  ProbeConfig{Rise: 2, Fall: 3},
+			}
+
+			var got []bool
+			for _, r := range tt.results {
+				got = append(got, p.record(r))
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prober.record() = %v, want %v", got, tt.want)
+			}
+			if p.isUp() != tt.wantUp {
+				t.Errorf("prober.isUp() = %v, want %v", p.isUp(), tt.wantUp)
+			}
+		})
+	}
+}
+
+func Test_newProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	host, p, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(p)
+
+	tests := []struct {
+		name    string
+		config  ProbeConfig
+		wantErr bool
+	}{
+		{
+			"tcp",
+			ProbeConfig{Type: probeTCP, Port: port},
+			false,
+		},
+		{
+			"http",
+			ProbeConfig{Type: probeHTTP, Port: port, Scheme: "http", Path: "/health", ExpectStatus: 200},
+			false,
+		},
+		{
+			"http unexpected status",
+			ProbeConfig{Type: probeHTTP, Port: port, Scheme: "http", Path: "/", ExpectStatus: 200},
+			true,
+		},
+		{
+			"tls without tls",
+			ProbeConfig{Type: probeTLS, Port: port, InsecureSkipVerify: true},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := newProbe(tt.config)
+			if err != nil {
+				t.Fatalf("newProbe() error = %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			if err := probe(ctx, host); (err != nil) != tt.wantErr {
+				t.Errorf("probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := newProbe(ProbeConfig{Type: "icmp"}); err == nil {
+		t.Error("newProbe() expected error for unknown type")
+	}
+}
+
+type ChanFetcher struct {
+	MockFetcher
+
+	resultCh chan *FetchResult
+	status   FetcherStatus
+
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+func (c *ChanFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+
+	select {
+	case r := <-c.resultCh:
+		return r
+	case <-ctx.Done():
+		return &FetchResult{}
+	}
+}
+
+func (c *ChanFetcher) Status() FetcherStatus {
+	return c.status
+}
+
+// lastContext returns the context of the most recent call to Fetch
+func (c *ChanFetcher) lastContext() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ctx
+}
+
+// testSpanContext returns a context carrying a span with a given trace ID
+func testSpanContext(id byte) context.Context {
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{id},
+		SpanID:  trace.SpanID{id},
+	})
+
+	return trace.ContextWithSpanContext(context.Background(), sc)
+}
+
+func TestProbeFetcher_Fetch(t *testing.T) {
+	var mu sync.Mutex
+	down := map[string]bool{"10.0.0.2": true}
+
+	backend := &ChanFetcher{resultCh: make(chan *FetchResult, 1)}
+	config := ProbeConfig{Type: probeTCP, Port: 1, Interval: time.Millisecond * 10, Timeout: time.Second, Rise: 1, Fall: 1}
+
+	f, err := NewProbeFetcher("foo", backend, config, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewProbeFetcher() error = %v", err)
+	}
+	f.(*ProbeFetcher).probe = func(ctx context.Context, address string) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if down[address] {
+			return errors.New("down")
+		}
+		return nil
+	}
+
+	fetch := func() []string {
+		resultCh := make(chan []string, 1)
+		go func() {
+			resultCh <- f.Fetch(context.Background(), "foo").Addresses
+		}()
+
+		select {
+		case a := <-resultCh:
+			return a
+		case <-time.After(time.Second * 5):
+			t.Fatal("Fetch() did not return")
+		}
+		return nil
+	}
+
+	// new addresses are probed before the first result
+	backend.resultCh <- &FetchResult{Addresses: []string{"10.0.0.1", "10.0.0.2"}}
+	if got := fetch(); !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("Fetch() = %v, want only the address that is up", got)
+	}
+
+	mu.Lock()
+	delete(down, "10.0.0.2")
+	mu.Unlock()
+
+	if got := fetch(); !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Fetch() = %v, want both addresses once up", got)
+	}
+
+	backend.resultCh <- &FetchResult{Addresses: []string{"10.0.0.2", "10.0.0.3"}}
+	if got := fetch(); !reflect.DeepEqual(got, []string{"10.0.0.2", "10.0.0.3"}) {
+		t.Errorf("Fetch() = %v, want the backend's healthy addresses, including the new address", got)
+	}
+}
+
+func TestProbeFetcher_Fetch_context(t *testing.T) {
+	backend := &ChanFetcher{resultCh: make(chan *FetchResult, 1)}
+	config := ProbeConfig{Type: probeTCP, Port: 1, Interval: time.Hour, Timeout: time.Second, Rise: 1, Fall: 1}
+
+	f, err := NewProbeFetcher("foo", backend, config, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewProbeFetcher() error = %v", err)
+	}
+	f.(*ProbeFetcher).probe = func(ctx context.Context, address string) error {
+		return nil
+	}
+
+	for i, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		ctx := testSpanContext(byte(i + 1))
+
+		resultCh := make(chan *FetchResult, 1)
+		go func() {
+			resultCh <- f.Fetch(ctx, "foo")
+		}()
+
+		// the wrapped Fetcher is called with the span of each call
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			c := backend.lastContext()
+			if c != nil && trace.SpanContextFromContext(c).Equal(trace.SpanContextFromContext(ctx)) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Fetch() %d did not call the wrapped Fetcher with its span", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		backend.resultCh <- &FetchResult{Addresses: []string{address}}
+		select {
+		case res := <-resultCh:
+			if !reflect.DeepEqual(res.Addresses, []string{address}) {
+				t.Errorf("Fetch() = %v, want %v", res.Addresses, address)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Fetch() did not return")
+		}
+	}
+}
+
+func TestProbeFetcher_Status(t *testing.T) {
+	status := FetcherStatus{LastSuccess: time.Now(), ConsecutiveErrors: 2}
+	backend := &ChanFetcher{resultCh: make(chan *FetchResult), status: status}
+	config := ProbeConfig{Type: probeTCP, Port: 1, Interval: time.Hour, Timeout: time.Second, Rise: 1, Fall: 1}
+
+	m, err := NewMonitor([]string{"foo"}, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewMonitor() error = %v", err)
+	}
+	m.Fetcher = func(service string, logger hclog.Logger) (Fetcher, error) {
+		return NewProbeFetcher(service, backend, config, logger)
+	}
+	if err := m.Run(make(chan *RecordEntry)); err != nil {
+		t.Fatalf("Monitor.Run() error = %v", err)
+	}
+
+	// probed services report the status of their backend
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		s, ok := m.Status()["foo"]
+		if ok {
+			if !reflect.DeepEqual(s, status) {
+				t.Errorf("Monitor.Status() = %v, want %v", s, status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Monitor.Status() does not include the probed service")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// shutting down the Monitor ends the wrapped Fetcher's fetch
+	deadline = time.Now().Add(time.Second * 5)
+	for backend.lastContext() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Fetch() did not call the wrapped Fetcher")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Monitor.Shutdown() error = %v", err)
+	}
+
+	select {
+	case <-backend.lastContext().Done():
+	case <-time.After(time.Second * 5):
+		t.Error("Monitor.Shutdown() did not end the wrapped Fetcher's fetch")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+const publishQueueSize = 100
+const publishRetries = 5
+
+// errCASConflict is returned when a key was modified between being read
+// and written
+var errCASConflict = errors.New("key was modified concurrently")
+
+// errStaleSelection is returned when the published selection is more
+// recent than the selection being written
+var errStaleSelection = errors.New("published selection is more recent")
+
+// kvClient is the subset of the Consul KV API used by a Publisher
+type kvClient interface {
+	Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+	CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+}
+
+// Selection is the value published for a service's selected record
+type Selection struct {
+	Address    string       `json:"address"`
+	SelectedAt time.Time    `json:"selected_at"`
+	Reason     ChangeReason `json:"reason"`
+	Instance   string       `json:"instance"`
+}
+
+// Publisher writes the selected record of each service to a Consul KV
+// prefix. Writes use check-and-set, and a selection is not written over a
+// more recent selection published by another instance. Selections are
+// ordered by wall clock time, so instances sharing a prefix must have
+// synchronized clocks.
+type Publisher struct {
+	prefix   string
+	instance string
+
+	kv    kvClient
+	queue chan *RecordChange
+
+	logger hclog.Logger
+
+	shutdownCh chan struct{}
+}
+
+// NewPublisher creates a new Publisher object for a given configuration
+func NewPublisher(config PublishConfig, logger hclog.Logger) (*Publisher, error) {
+	client, err := api.NewClient(api.DefaultConfigWithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+
+	instance := config.Instance
+	if instance == "" {
+		instance = instanceID(defaultRegistrationName)
+	}
+
+	return &Publisher{
+		prefix:     config.Prefix,
+		instance:   instance,
+		kv:         client.KV(),
+		queue:      make(chan *RecordChange, publishQueueSize),
+		logger:     logger.With("prefix", config.Prefix),
+		shutdownCh: make(chan struct{}),
+	}, nil
+}
+
+// RecordChanged implements ChangeListener. Changes that leave the served
+// address in place are not published, and changes are dropped if the queue
+// is full.
+func (p *Publisher) RecordChanged(c *RecordChange) {
+	if c.OldAddress == c.NewAddress {
+		return
+	}
+
+	select {
+	case p.queue <- c:
+	default:
+		p.logger.Warn("Publish queue is full, dropping change", "service", c.Service, "address", c.NewAddress)
+		kvPublish.WithLabelValues(c.Service, "dropped").Inc()
+	}
+}
+
+// Run spawns a goroutine to publish queued changes
+func (p *Publisher) Run() {
+	go func() {
+		for {
+			select {
+			case <-p.shutdownCh:
+				return
+			case c := <-p.queue:
+				result, err := p.publish(c)
+				if err != nil {
+					p.logger.Error("Failed to publish selection", "service", c.Service, "error", err)
+				}
+				kvPublish.WithLabelValues(c.Service, result).Inc()
+			}
+		}
+	}()
+}
+
+// publish writes a change to the key for its service, retrying with an
+// exponential backoff if the key was modified concurrently. It returns the
+// result of the publish for use as a metric label.
+func (p *Publisher) publish(c *RecordChange) (string, error) {
+	s := Selection{
+		Address:    c.NewAddress,
+		SelectedAt: c.Time,
+		Reason:     c.Reason,
+		Instance:   p.instance,
+	}
+
+	value, err := json.Marshal(s)
+	if err != nil {
+		return "failed", err
+	}
+
+	key := path.Join(p.prefix, c.Service)
+
+	var attempt uint64
+	for {
+		err = p.write(key, s, value)
+		if err == errStaleSelection {
+			return "stale", nil
+		}
+		if err == nil {
+			return "published", nil
+		}
+		if attempt >= publishRetries {
+			return "failed", err
+		}
+		attempt++
+
+		select {
+		case <-p.shutdownCh:
+			return "failed", err
+		case <-time.After(backoffDuration(attempt)):
+		}
+	}
+}
+
+func (p *Publisher) write(key string, s Selection, value []byte) error {
+	pair, _, err := p.kv.Get(key, nil)
+	if err != nil {
+		return err
+	}
+
+	var index uint64
+	if pair != nil {
+		index = pair.ModifyIndex
+
+		var current Selection
+		if err := json.Unmarshal(pair.Value, &current); err == nil && current.SelectedAt.After(s.SelectedAt) {
+			return errStaleSelection
+		}
+	}
+
+	ok, _, err := p.kv.CAS(&api.KVPair{
+		Key:         key,
+		Value:       value,
+		ModifyIndex: index,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errCASConflict
+	}
+
+	return nil
+}
+
+// Shutdown ends publishing. Queued changes are discarded.
+func (p *Publisher) Shutdown(ctx context.Context) error {
+	close(p.shutdownCh)
+	return nil
+}
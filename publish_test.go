@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// MockKV is an in-memory kvClient. If conflicts is positive, that many CAS
+// calls fail as though the key was written concurrently.
+type MockKV struct {
+	mu        sync.Mutex
+	pairs     map[string]*api.KVPair
+	index     uint64
+	conflicts int
+}
+
+func NewMockKV() *MockKV {
+	return &MockKV{pairs: make(map[string]*api.KVPair)}
+}
+
+func (m *MockKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.pairs[key], &api.QueryMeta{}, nil
+}
+
+func (m *MockKV) CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conflicts > 0 {
+		m.conflicts--
+		return false, &api.WriteMeta{}, nil
+	}
+
+	var index uint64
+	if current, ok := m.pairs[p.Key]; ok {
+		index = current.ModifyIndex
+	}
+	if index != p.ModifyIndex {
+		return false, &api.WriteMeta{}, nil
+	}
+
+	m.index++
+	m.pairs[p.Key] = &api.KVPair{Key: p.Key, Value: p.Value, ModifyIndex: m.index}
+	return true, &api.WriteMeta{}, nil
+}
+
+func (m *MockKV) set(key string, s Selection) {
+	b, _ := json.Marshal(s)
+	m.index++
+	m.pairs[key] = &api.KVPair{Key: key, Value: b, ModifyIndex: m.index}
+}
+
+func TestPublisher_publish(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		existing    *Selection
+		conflicts   int
+		wantResult  string
+		wantAddress string
+	}{
+		{
+			"new key",
+			nil,
+			0,
+			"published",
+			"10.0.0.2",
+		},
+		{
+			"older selection",
+			&Selection{Address: "10.0.0.1", SelectedAt: now.Add(-time.Minute), Instance: "other"},
+			0,
+			"published",
+			"10.0.0.2",
+		},
+		{
+			"newer selection",
+			&Selection{Address: "10.0.0.3", SelectedAt: now.Add(time.Minute), Instance: "other"},
+			0,
+			"stale",
+			"10.0.0.3",
+		},
+		{
+			"concurrent write",
+			nil,
+			1,
+			"published",
+			"10.0.0.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := NewMockKV()
+			kv.conflicts = tt.conflicts
+			if tt.existing != nil {
+				kv.set("hobson/bar", *tt.existing)
+			}
+
+			p := &Publisher{
+				prefix:     "hobson",
+				instance:   "test",
+				kv:         kv,
+				logger:     hclog.NewNullLogger(),
+				shutdownCh: make(chan struct{}),
+			}
+
+			result, err := p.publish(&RecordChange{
+				Time:       now,
+				Service:    "bar",
+				OldAddress: "10.0.0.1",
+				NewAddress: "10.0.0.2",
+				Reason:     ReasonUnhealthy,
+			})
+			if err != nil {
+				t.Fatalf("Publisher.publish() error = %v", err)
+			}
+			if result != tt.wantResult {
+				t.Errorf("Publisher.publish() = %v, want %v", result, tt.wantResult)
+			}
+
+			var s Selection
+			if err := json.Unmarshal(kv.pairs["hobson/bar"].Value, &s); err != nil {
+				t.Fatalf("published invalid selection: %v", err)
+			}
+			if s.Address != tt.wantAddress {
+				t.Errorf("published address = %v, want %v", s.Address, tt.wantAddress)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// Registration registers hobson as a Consul service, with a TTL check that
+// is updated by sending a DNS query to hobson's own listener
+type Registration struct {
+	config RegistrationConfig
+	id     string
+	target string
+	name   string
+
+	client *api.Client
+
+	logger hclog.Logger
+
+	shutdownCh chan struct{}
+}
+
+// NewRegistration creates a new Registration object. Queries are sent to
+// bind, for the record of a given service in zone.
+func NewRegistration(config RegistrationConfig, bind, zone, service string, logger hclog.Logger) (*Registration, error) {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	id := config.ID
+	if id == "" {
+		id = instanceID(config.Name)
+	}
+
+	client, err := api.NewClient(api.DefaultConfigWithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Registration{
+		config:     config,
+		id:         id,
+		target:     net.JoinHostPort(host, port),
+		name:       dns.Fqdn(service + "." + zone),
+		client:     client,
+		logger:     logger.With("id", id),
+		shutdownCh: make(chan struct{}),
+	}, nil
+}
+
+// instanceID returns an identifier for this hobson instance, unique
+// among the instances registered with a given name
+func instanceID(name string) string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return name
+	}
+
+	return name + "-" + hostname
+}
+
+func (r *Registration) checkID() string {
+	return "service:" + r.id
+}
+
+// Run registers the service in Consul, and spawns a goroutine to update its
+// check every CheckInterval
+func (r *Registration) Run() error {
+	_, port, _ := net.SplitHostPort(r.target)
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	err = r.client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:      r.id,
+		Name:    r.config.Name,
+		Address: r.config.Address,
+		Port:    p,
+		Tags:    r.config.Tags,
+		Meta:    r.config.Meta,
+		Check: &api.AgentServiceCheck{
+			CheckID: r.checkID(),
+			Name:    "hobson DNS query",
+			TTL:     (r.config.CheckInterval * 3).String(),
+			Notes:   fmt.Sprintf("Updated every %s by querying %s for %s", r.config.CheckInterval, r.target, r.name),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	r.logger.Info("Registered in Consul", "name", r.config.Name)
+
+	go func() {
+		t := time.NewTicker(r.config.CheckInterval)
+		defer t.Stop()
+
+		for {
+			r.updateCheck()
+
+			select {
+			case <-r.shutdownCh:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *Registration) updateCheck() {
+	status, output := r.query()
+
+	err := r.client.Agent().UpdateTTL(r.checkID(), output, status)
+	if err != nil {
+		r.logger.Error("Failed to update check", "error", err)
+	}
+}
+
+// query sends a DNS query to the listener. The check passes if the record
+// is served, and warns if the listener answers without it.
+func (r *Registration) query() (string, string) {
+	c := &dns.Client{Timeout: r.config.CheckTimeout}
+
+	msg := &dns.Msg{}
+	msg.SetQuestion(r.name, dns.TypeA)
+
+	resp, _, err := c.Exchange(msg, r.target)
+	if err != nil {
+		return api.HealthCritical, fmt.Sprintf("Query for %s failed: %s", r.name, err)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return api.HealthWarning, fmt.Sprintf("Query for %s returned %s with %d answers",
+			r.name, dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+
+	return api.HealthPassing, fmt.Sprintf("Query for %s returned %s", r.name, resp.Answer[0])
+}
+
+// Shutdown stops updating the check, and deregisters the service from Consul
+func (r *Registration) Shutdown(ctx context.Context) error {
+	close(r.shutdownCh)
+
+	err := r.client.Agent().ServiceDeregister(r.id)
+	if err != nil {
+		return err
+	}
+	r.logger.Info("Deregistered from Consul")
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+func TestRegistration_query(t *testing.T) {
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.svcMap["bar.foo."] = net.ParseIP("127.0.0.1")
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: h}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	// a closed listener, to which queries fail
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		record string
+		want   string
+	}{
+		{
+			"served record",
+			pc.LocalAddr().String(),
+			"bar.foo.",
+			api.HealthPassing,
+		},
+		{
+			"unknown record",
+			pc.LocalAddr().String(),
+			"baz.foo.",
+			api.HealthWarning,
+		},
+		{
+			"no listener",
+			closed.LocalAddr().String(),
+			"bar.foo.",
+			api.HealthCritical,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Registration{
+				config: RegistrationConfig{CheckTimeout: time.Millisecond * 500},
+				target: tt.target,
+				name:   tt.record,
+			}
+			if got, output := r.query(); got != tt.want {
+				t.Errorf("Registration.query() = %v (%s), want %v", got, output, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/p0pr0ck5/hobson"
+
+// Span names used by hobson. Query spans are sampled separately from the
+// spans that follow a service's records from Consul to the DNSHandler.
+const (
+	spanFetch   = "hobson.monitor.fetch"
+	spanNotify  = "hobson.monitor.notify"
+	spanConsul  = "hobson.consul.query"
+	spanBackoff = "hobson.consul.backoff"
+	spanUpdate  = "hobson.record.update"
+	spanQuery   = "hobson.dns.query"
+)
+
+// tracer returns a Tracer from the global TracerProvider. When tracing is
+// not configured, this is a no-op Tracer.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// querySampler samples DNS query spans at a different ratio than all
+// other spans
+type querySampler struct {
+	query   sdktrace.Sampler
+	records sdktrace.Sampler
+}
+
+func (s querySampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.Name == spanQuery {
+		return s.query.ShouldSample(p)
+	}
+
+	return s.records.ShouldSample(p)
+}
+
+func (s querySampler) Description() string {
+	return "QuerySampler{" + s.query.Description() + "," + s.records.Description() + "}"
+}
+
+// NewTracerProvider creates a TracerProvider exporting spans via OTLP over
+// HTTP, and installs it as the global TracerProvider
+func NewTracerProvider(config TracingConfig) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(config.Endpoint),
+	}
+	if config.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "hobson"),
+		)),
+		sdktrace.WithSampler(querySampler{
+			query:   sdktrace.TraceIDRatioBased(config.QuerySampleRatio),
+			records: sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio)),
+		}),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// OnceFetcher returns a set of addresses on its first Fetch, and blocks on
+// every subsequent Fetch
+type OnceFetcher struct {
+	addresses []string
+	done      chan struct{}
+	fetched   bool
+}
+
+func (o *OnceFetcher) Fetch(ctx context.Context, service string) *FetchResult {
+	if o.fetched {
+		<-o.done
+		return &FetchResult{}
+	}
+	o.fetched = true
+	return &FetchResult{Addresses: o.addresses}
+}
+
+func TestTracing_linked(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	m, _ := NewMonitor([]string{"bar"}, hclog.NewNullLogger())
+	m.Fetcher = func(service string, logger hclog.Logger) (Fetcher, error) {
+		return &OnceFetcher{addresses: []string{"127.0.0.1"}, done: done}, nil
+	}
+
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	l := &MockListener{}
+	h.AddListener(l)
+
+	notify := make(chan *RecordEntry)
+	h.Watch(notify)
+	if err := m.Run(notify); err != nil {
+		t.Fatalf("Monitor.Run() error = %v", err)
+	}
+	defer m.Shutdown(context.Background())
+	defer h.Shutdown(context.Background())
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		for _, s := range sr.Ended() {
+			spans[s.Name()] = s
+		}
+		if _, ok := spans[spanUpdate]; ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	fetch, notifySpan, update := spans[spanFetch], spans[spanNotify], spans[spanUpdate]
+	if fetch == nil || notifySpan == nil || update == nil {
+		t.Fatalf("expected fetch, notify and update spans, saw %v", spans)
+	}
+
+	if notifySpan.Parent().SpanID() != fetch.SpanContext().SpanID() {
+		t.Errorf("notify span parent = %v, want fetch span %v", notifySpan.Parent().SpanID(), fetch.SpanContext().SpanID())
+	}
+	if update.Parent().SpanID() != notifySpan.SpanContext().SpanID() {
+		t.Errorf("update span parent = %v, want notify span %v", update.Parent().SpanID(), notifySpan.SpanContext().SpanID())
+	}
+	if update.SpanContext().TraceID() != fetch.SpanContext().TraceID() {
+		t.Errorf("update span trace = %v, want %v", update.SpanContext().TraceID(), fetch.SpanContext().TraceID())
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// View answers queries from clients in a set of networks with records
+// selected independently of other views, by its own Monitor and DNSHandler
+type View struct {
+	Name string
+
+	networks []*net.IPNet
+
+	monitor *Monitor
+	handler *DNSHandler
+}
+
+// NewView creates a View for a given configuration, monitoring a set of
+// services with Fetchers created by fetcher
+func NewView(config ViewConfig, zone string, services []string, fetcher func(string, hclog.Logger) (Fetcher, error), logger hclog.Logger) (*View, error) {
+	logger = logger.With("view", config.Name)
+
+	v := &View{Name: config.Name}
+	for _, n := range config.Networks {
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		v.networks = append(v.networks, network)
+	}
+
+	m, err := NewMonitor(services, logger.Named("monitor"))
+	if err != nil {
+		return nil, err
+	}
+	m.Fetcher = fetcher
+	m.view = config.Name
+	v.monitor = m
+
+	v.handler = NewDNSHandler(zone, logger.Named("dns"))
+	v.handler.view = config.Name
+
+	return v, nil
+}
+
+// Contains returns true if an address is in one of the view's networks
+func (v *View) Contains(ip net.IP) bool {
+	for _, n := range v.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddListener registers a ChangeListener to be notified of changes to the
+// view's records
+func (v *View) AddListener(l ChangeListener) {
+	v.handler.AddListener(l)
+}
+
+// Run begins monitoring the view's services
+func (v *View) Run() error {
+	notify := make(chan *RecordEntry)
+
+	if err := v.monitor.Run(notify); err != nil {
+		return err
+	}
+	v.handler.Watch(notify)
+
+	return nil
+}
+
+// Shutdown ends monitoring of the view's services
+func (v *View) Shutdown(ctx context.Context) error {
+	if err := v.monitor.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	return v.handler.Shutdown(ctx)
+}
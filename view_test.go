@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+type RemoteResponseWriter struct {
+	MockResponseWriter
+
+	remote net.Addr
+}
+
+func (r *RemoteResponseWriter) RemoteAddr() net.Addr {
+	return r.remote
+}
+
+func Test_clientIP(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{
+			"udp",
+			&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53},
+			"10.0.0.1",
+		},
+		{
+			"tcp",
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 53},
+			"10.0.0.2",
+		},
+		{
+			"address without port",
+			&MockAddr{},
+			"127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientIP(tt.addr); got.String() != tt.want {
+				t.Errorf("clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsHandler_ServeDNS_view(t *testing.T) {
+	h := NewDNSHandler("foo", hclog.NewNullLogger())
+	h.UpdateRecord("bar", []string{"10.0.0.1"})
+
+	dmz, err := NewView(ViewConfig{Name: "dmz", Networks: []string{"192.0.2.0/24"}}, "foo", []string{"bar"}, NewMockFetcher, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatalf("NewView() error = %v", err)
+	}
+	l := &MockListener{}
+	dmz.AddListener(l)
+	dmz.handler.UpdateRecord("bar", []string{"203.0.113.1"})
+	h.AddView(dmz)
+
+	tests := []struct {
+		name   string
+		remote net.Addr
+		want   string
+	}{
+		{
+			"default view",
+			&net.UDPAddr{IP: net.ParseIP("10.1.0.1"), Port: 5353},
+			"10.0.0.1",
+		},
+		{
+			"client in view",
+			&net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353},
+			"203.0.113.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &RemoteResponseWriter{remote: tt.remote}
+			r := &dns.Msg{}
+			r.SetQuestion("bar.foo.", dns.TypeA)
+
+			h.ServeDNS(w, r)
+
+			m := w.GetM()
+			if len(m.Answer) != 1 {
+				t.Fatalf("ServeDNS() answers = %d, want 1", len(m.Answer))
+			}
+			if got := m.Answer[0].(*dns.A).A.String(); got != tt.want {
+				t.Errorf("ServeDNS() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if len(l.changes) != 1 || l.changes[0].View != "dmz" {
+		t.Errorf("View changes = %v, want one change in view dmz", l.changes)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const webhookSignatureHeader = "X-Hobson-Signature"
+
+// webhookTemplates render the body of a webhook request for a RecordChange
+var webhookTemplates = map[string]func(*RecordChange) ([]byte, error){
+	"json": func(c *RecordChange) ([]byte, error) {
+		return json.Marshal(struct {
+			Event string `json:"event"`
+			*RecordChange
+		}{
+			Event:        "record_change",
+			RecordChange: c,
+		})
+	},
+	"slack": func(c *RecordChange) ([]byte, error) {
+		text := fmt.Sprintf("hobson: record for *%s* changed from `%s` to `%s` (%s)",
+			c.Service, c.OldAddress, c.NewAddress, c.Reason)
+		if c.Reason == ReasonEmptyPool {
+			text = fmt.Sprintf("hobson: no healthy records for *%s*, still serving `%s`",
+				c.Service, c.NewAddress)
+		}
+
+		return json.Marshal(struct {
+			Text string `json:"text"`
+		}{
+			Text: text,
+		})
+	},
+}
+
+// Webhook delivers record changes to an HTTP endpoint. Changes are queued and
+// delivered in the background, so slow receivers do not block record updates.
+type Webhook struct {
+	config   WebhookConfig
+	services map[string]bool
+	render   func(*RecordChange) ([]byte, error)
+
+	client *http.Client
+	queue  chan *RecordChange
+
+	logger hclog.Logger
+
+	shutdownCh chan struct{}
+}
+
+// NewWebhook creates a new Webhook object for a given configuration
+func NewWebhook(config WebhookConfig, logger hclog.Logger) (*Webhook, error) {
+	render, ok := webhookTemplates[config.Template]
+	if !ok {
+		return nil, fmt.Errorf("unknown webhook template %q", config.Template)
+	}
+
+	services := make(map[string]bool)
+	for _, s := range config.Services {
+		services[s] = true
+	}
+
+	return &Webhook{
+		config:     config,
+		services:   services,
+		render:     render,
+		client:     &http.Client{Timeout: config.Timeout},
+		queue:      make(chan *RecordChange, config.QueueSize),
+		logger:     logger.With("url", config.URL),
+		shutdownCh: make(chan struct{}),
+	}, nil
+}
+
+// RecordChanged implements ChangeListener. Changes are dropped if the
+// delivery queue is full.
+func (w *Webhook) RecordChanged(c *RecordChange) {
+	if len(w.services) > 0 && !w.services[c.Service] {
+		return
+	}
+
+	select {
+	case w.queue <- c:
+	default:
+		w.logger.Warn("Webhook queue is full, dropping change", "service", c.Service, "address", c.NewAddress)
+		webhookNotification.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Run spawns a goroutine to deliver queued changes
+func (w *Webhook) Run() {
+	go func() {
+		for {
+			select {
+			case <-w.shutdownCh:
+				return
+			case c := <-w.queue:
+				if err := w.deliver(c); err != nil {
+					w.logger.Error("Failed to deliver webhook", "service", c.Service, "error", err)
+					webhookNotification.WithLabelValues("failed").Inc()
+					continue
+				}
+				webhookNotification.WithLabelValues("sent").Inc()
+			}
+		}
+	}()
+}
+
+// deliver sends a change to the webhook endpoint, retrying with an
+// exponential backoff
+func (w *Webhook) deliver(c *RecordChange) error {
+	body, err := w.render(c)
+	if err != nil {
+		return err
+	}
+
+	var attempt uint64
+	for {
+		err = w.send(body)
+		if err == nil || attempt >= w.config.Retries {
+			return err
+		}
+		attempt++
+
+		select {
+		case <-w.shutdownCh:
+			return err
+		case <-time.After(backoffDuration(attempt)):
+		}
+	}
+}
+
+func (w *Webhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if w.config.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(w.config.Secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Shutdown ends webhook delivery. Queued changes are discarded.
+func (w *Webhook) Shutdown(ctx context.Context) error {
+	close(w.shutdownCh)
+	return nil
+}
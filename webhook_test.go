@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+type webhookRequest struct {
+	body      []byte
+	signature string
+}
+
+func TestWebhook_RecordChanged(t *testing.T) {
+	change := &RecordChange{
+		Time:       time.Now(),
+		Service:    "bar",
+		OldAddress: "127.0.0.1",
+		NewAddress: "127.0.0.2",
+		Healthy:    []string{"127.0.0.2"},
+		Reason:     ReasonUnhealthy,
+	}
+
+	tests := []struct {
+		name      string
+		config    WebhookConfig
+		failures  int
+		wantField string
+		wantSent  bool
+	}{
+		{
+			"json template",
+			WebhookConfig{
+				Template: "json",
+			},
+			0,
+			"new_address",
+			true,
+		},
+		{
+			"slack template",
+			WebhookConfig{
+				Template: "slack",
+			},
+			0,
+			"text",
+			true,
+		},
+		{
+			"signed request",
+			WebhookConfig{
+				Template: "json",
+				Secret:   "s3cr3t",
+			},
+			0,
+			"event",
+			true,
+		},
+		{
+			"retry after failure",
+			WebhookConfig{
+				Template: "json",
+				Retries:  1,
+			},
+			1,
+			"service",
+			true,
+		},
+		{
+			"filtered service",
+			WebhookConfig{
+				Template: "json",
+				Services: []string{"foo"},
+			},
+			0,
+			"",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqs := make(chan webhookRequest, 1)
+			failures := tt.failures
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failures > 0 {
+					failures--
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				body, _ := ioutil.ReadAll(r.Body)
+				reqs <- webhookRequest{
+					body:      body,
+					signature: r.Header.Get(webhookSignatureHeader),
+				}
+			}))
+			defer srv.Close()
+
+			tt.config.URL = srv.URL
+			tt.config.Timeout = time.Second
+			tt.config.QueueSize = 1
+
+			w, err := NewWebhook(tt.config, hclog.NewNullLogger())
+			if err != nil {
+				t.Fatalf("NewWebhook() error = %v", err)
+			}
+			w.Run()
+			defer w.Shutdown(context.Background())
+
+			w.RecordChanged(change)
+
+			select {
+			case req := <-reqs:
+				if !tt.wantSent {
+					t.Fatalf("RecordChanged() sent unexpected request")
+				}
+
+				var payload map[string]interface{}
+				if err := json.Unmarshal(req.body, &payload); err != nil {
+					t.Fatalf("RecordChanged() sent invalid JSON: %v", err)
+				}
+				if _, ok := payload[tt.wantField]; !ok {
+					t.Errorf("RecordChanged() payload missing %q: %s", tt.wantField, req.body)
+				}
+
+				if tt.config.Secret != "" {
+					want := "sha256=" + signWebhook(tt.config.Secret, req.body)
+					if req.signature != want {
+						t.Errorf("RecordChanged() signature = %v, want %v", req.signature, want)
+					}
+				}
+			case <-time.After(time.Second * 2):
+				if tt.wantSent {
+					t.Fatalf("RecordChanged() sent no request")
+				}
+			}
+		})
+	}
+}